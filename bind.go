@@ -0,0 +1,352 @@
+package kittla
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Converts o to a Go value of type t.
+func (k *Kittla) toGo(o *obj, t reflect.Type) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+
+	if h, present := k.handle(o); present && h.value != nil && t.Kind() != reflect.String && reflect.TypeOf(h.value).AssignableTo(t) {
+		v.Set(reflect.ValueOf(h.value))
+		return v, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := k.convertTo(o, "int")
+		if err != nil {
+			return v, err
+		}
+		if v.OverflowInt(int64(i.valInt)) {
+			return v, fmt.Errorf("%d doesn't fit in %s", i.valInt, t)
+		}
+		v.SetInt(int64(i.valInt))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := k.convertTo(o, "int")
+		if err != nil {
+			return v, err
+		}
+		if i.valInt < 0 || v.OverflowUint(uint64(i.valInt)) {
+			return v, fmt.Errorf("%d doesn't fit in %s", i.valInt, t)
+		}
+		v.SetUint(uint64(i.valInt))
+	case reflect.Float32, reflect.Float64:
+		f, err := k.convertTo(o, "float")
+		if err != nil {
+			return v, err
+		}
+		v.SetFloat(f.valFloat)
+	case reflect.Bool:
+		b, err := k.convertTo(o, "bool")
+		if err != nil {
+			return v, err
+		}
+		v.SetBool(b.valBool)
+	case reflect.String:
+		v.SetString(o.toString())
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte{}, o.toBytes()...))
+			break
+		}
+		l, err := o.toList()
+		if err != nil {
+			return v, err
+		}
+		v.Set(reflect.MakeSlice(t, len(l), len(l)))
+		for i := range l {
+			e, err := k.toGo(l[i], t.Elem())
+			if err != nil {
+				return v, err
+			}
+			v.Index(i).Set(e)
+		}
+	case reflect.Map:
+		// A list of keys and values
+		l, err := o.toList()
+		if err != nil {
+			return v, err
+		}
+		if len(l)%2 != 0 {
+			return v, fmt.Errorf("must be a list of keys and values, got \"%s\"", o.toString())
+		}
+		v.Set(reflect.MakeMapWithSize(t, len(l)/2))
+		for i := 0; i < len(l); i += 2 {
+			key, err := k.toGo(l[i], t.Key())
+			if err != nil {
+				return v, err
+			}
+			val, err := k.toGo(l[i+1], t.Elem())
+			if err != nil {
+				return v, err
+			}
+			v.SetMapIndex(key, val)
+		}
+	case reflect.Interface:
+		if t.NumMethod() != 0 {
+			return v, fmt.Errorf("must be a handle of %s, got \"%s\"", t, o.toString())
+		}
+		if e := o.toAny(); e != nil {
+			v.Set(reflect.ValueOf(e))
+		}
+	case reflect.Pointer, reflect.Struct, reflect.Chan, reflect.Func:
+		return v, fmt.Errorf("must be a handle of %s, got \"%s\"", t, o.toString())
+	default:
+		return v, fmt.Errorf("can't convert to %s", t)
+	}
+	return v, nil
+}
+
+// The natural Go value of o, for parameters of type any.
+func (o *obj) toAny() any {
+	switch o.valType {
+	case valTypeInt:
+		return o.valInt
+	case valTypeFloat:
+		return o.valFloat
+	case valTypeBool:
+		return o.valBool
+	case valTypeList:
+		l := make([]any, len(o.valList))
+		for i := range o.valList {
+			l[i] = o.valList[i].toAny()
+		}
+		return l
+	case valTypeHandle:
+		return o.valHandle.value
+	}
+	return o.toString()
+}
+
+// Converts a Go value to a kittla value.
+func (k *Kittla) fromGo(v reflect.Value) *obj {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &obj{valType: valTypeInt, valInt: int(v.Int())}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &obj{valType: valTypeInt, valInt: int(v.Uint())}
+	case reflect.Float32, reflect.Float64:
+		return &obj{valType: valTypeFloat, valFloat: v.Float()}
+	case reflect.Bool:
+		return &obj{valType: valTypeBool, valBool: v.Bool()}
+	case reflect.String:
+		return &obj{valType: valTypeStr, valStr: []byte(v.String())}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 && v.Kind() == reflect.Slice {
+			return &obj{valType: valTypeStr, valStr: append([]byte{}, v.Bytes()...)}
+		}
+		l := make([]*obj, v.Len())
+		for i := range l {
+			l[i] = k.fromGo(v.Index(i))
+		}
+		return newList(l)
+	case reflect.Map:
+		// Keys and values, sorted by key
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return k.fromGo(keys[i]).toString() < k.fromGo(keys[j]).toString() })
+		l := make([]*obj, 0, 2*len(keys))
+		for _, key := range keys {
+			l = append(l, k.fromGo(key), k.fromGo(v.MapIndex(key)))
+		}
+		return newList(l)
+	case reflect.Interface:
+		if v.IsNil() {
+			return &obj{valType: valTypeStr}
+		}
+		return k.fromGo(v.Elem())
+	case reflect.Pointer, reflect.Chan, reflect.Func:
+		if v.IsNil() {
+			return &obj{valType: valTypeStr}
+		}
+	case reflect.Invalid:
+		return &obj{valType: valTypeStr}
+	}
+	// Anything else is given to scripts as a handle
+	return k.handleFor(v)
+}
+
+// Bind makes the Go function fn the command name. Arguments are converted to the types of the
+// parameters of fn: integers, floats, bools, strings, slices from lists, maps from lists of keys
+// and values, and any. Other values, like pointers, are passed as handles, see NewHandle. A
+// leading context.Context parameter gets the context of k, and a variadic fn takes any number of
+// trailing arguments. The results of fn are returned, as a list if more than one. A non-nil
+// trailing error fails the command. caps are the capabilities the command needs, see
+// WithCapabilities. Without them, the command isn't made.
+func (k *Kittla) Bind(name string, fn any, caps ...Capability) error {
+	fv := reflect.ValueOf(fn)
+	if !fv.IsValid() || (fv.Kind() == reflect.Func && fv.IsNil()) {
+		return fmt.Errorf("%s: can't bind nil", name)
+	}
+	if fv.Kind() != reflect.Func {
+		return fmt.Errorf("%s: can't bind %s, not a function", name, fv.Type())
+	}
+
+	name = k.qualifyCmd(name)
+	c, err := k.bindFunc(name, fv)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	c.caps = capsOf(caps)
+	k.setAllowed(name, c)
+	return nil
+}
+
+// A command calling the Go function fv, see Bind.
+func (k *Kittla) bindFunc(name string, fv reflect.Value) (*command, error) {
+	ft := fv.Type()
+
+	first := 0
+	if ft.NumIn() > 0 && ft.In(0) == contextType {
+		first = 1
+	}
+	minArgs := ft.NumIn() - first
+	maxArgs := minArgs
+	if ft.IsVariadic() {
+		minArgs--
+		maxArgs = -1
+	}
+	for i := first; i < ft.NumIn(); i++ {
+		if !isConvertible(ft.In(i)) {
+			return nil, fmt.Errorf("can't convert arguments to %s", ft.In(i))
+		}
+	}
+
+	hasErr := ft.NumOut() > 0 && ft.Out(ft.NumOut()-1) == errorType
+
+	c := &command{
+		names:   []string{name},
+		minArgs: minArgs,
+		maxArgs: maxArgs,
+		id:      k.nextFnId,
+		fn: func(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+			in := make([]reflect.Value, 0, first+len(args))
+			if first == 1 {
+				in = append(in, reflect.ValueOf(k.ctx))
+			}
+			for i := range args {
+				var t reflect.Type
+				if ft.IsVariadic() && first+i >= ft.NumIn()-1 {
+					t = ft.In(ft.NumIn() - 1).Elem()
+				} else {
+					t = ft.In(first + i)
+				}
+				v, err := k.toGo(args[i], t)
+				if err != nil {
+					return nil, fmt.Errorf("%s: argument %d %v. Line: %d", cmd, i+1, err, k.currLine)
+				}
+				in = append(in, v)
+			}
+
+			out := fv.Call(in)
+			if hasErr {
+				if err := out[len(out)-1]; !err.IsNil() {
+					return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err.Interface(), k.currLine)
+				}
+				out = out[:len(out)-1]
+			}
+
+			switch len(out) {
+			case 0:
+				return nil, nil
+			case 1:
+				return k.fromGo(out[0]), nil
+			}
+			res := make([]*obj, len(out))
+			for i := range out {
+				res[i] = k.fromGo(out[i])
+			}
+			return newList(res), nil
+		},
+	}
+	k.nextFnId++
+	return c, nil
+}
+
+// Whether kittla values can be converted to t at all.
+func isConvertible(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Bool, reflect.String:
+		return true
+	case reflect.Slice:
+		return isConvertible(t.Elem())
+	case reflect.Map:
+		return isConvertible(t.Key()) && isConvertible(t.Elem())
+	case reflect.Interface, reflect.Pointer, reflect.Struct, reflect.Chan, reflect.Func:
+		// Given as handles
+		return true
+	}
+	return false
+}
+
+// BindObject makes the struct ptr points to the command name. The exported methods of the struct
+// are subcommands, called like `name Method args...`, and the exported fields are read and written
+// with `name get Field` and `name set Field value`. Methods with parameters that can't be converted
+// are left out. caps are the capabilities the command needs, like for Bind.
+func (k *Kittla) BindObject(name string, ptr any, caps ...Capability) error {
+	pv := reflect.ValueOf(ptr)
+	if pv.Kind() != reflect.Pointer || pv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("%s: can't bind %T, not a pointer to a struct", name, ptr)
+	}
+	sv := pv.Elem()
+
+	field := func(cmd string, name *obj) (reflect.Value, error) {
+		if f, present := sv.Type().FieldByName(name.toString()); present && f.IsExported() {
+			return sv.FieldByIndex(f.Index), nil
+		}
+		return reflect.Value{}, fmt.Errorf("%s: no field %s. Line: %d", cmd, name.toString(), k.currLine)
+	}
+
+	e := ensemble{
+		"get": {minArgs: 1, maxArgs: 1, fn: func(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+			f, err := field(cmd, args[0])
+			if err != nil {
+				return nil, err
+			}
+			return k.fromGo(f), nil
+		}},
+		"set": {minArgs: 2, maxArgs: 2, fn: func(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+			f, err := field(cmd, args[0])
+			if err != nil {
+				return nil, err
+			}
+			v, err := k.toGo(args[1], f.Type())
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s %v. Line: %d", cmd, args[0].toString(), err, k.currLine)
+			}
+			f.Set(v)
+			return args[1], nil
+		}},
+	}
+
+	for i := 0; i < pv.NumMethod(); i++ {
+		m := pv.Type().Method(i)
+		if c, err := k.bindFunc(m.Name, pv.Method(i)); err == nil {
+			e[m.Name] = c
+		}
+	}
+
+	name = k.qualifyCmd(name)
+	k.setAllowed(name, &command{
+		names:    []string{name},
+		minArgs:  1,
+		maxArgs:  -1,
+		id:       k.nextFnId,
+		fn:       e.dispatch,
+		ensemble: e,
+		caps:     capsOf(caps),
+	})
+	k.nextFnId++
+	return nil
+}
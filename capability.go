@@ -0,0 +1,95 @@
+package kittla
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Capability is what a command needs from the host to be usable, like access to the file system.
+// Commands needing a capability the interpreter wasn't given don't exist for its scripts.
+type Capability uint
+
+const (
+	CAP_FS   Capability = 1 << iota // Files: file, glob, open, package and source
+	CAP_EXEC                        // Running programs, for commands of the host
+	CAP_NET                         // Network access, for commands of the host
+	CAP_ENV                         // Environment variables, for commands of the host
+	CAP_TIME                        // Waiting and scheduling: after and vwait
+
+	CAP_NONE Capability = 0
+	CAP_ALL             = CAP_FS | CAP_EXEC | CAP_NET | CAP_ENV | CAP_TIME
+)
+
+var capNames = []string{"fs", "exec", "net", "env", "time"}
+
+func (c Capability) String() string {
+	names := make([]string, 0, len(capNames))
+	for i, n := range capNames {
+		if c&(1<<i) != 0 {
+			names = append(names, n)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// Option configures a new Kittla instance, see New.
+type Option func(k *Kittla)
+
+// WithCapabilities only allows commands needing the given capabilities. Without this option,
+// all capabilities are given.
+func WithCapabilities(caps ...Capability) Option {
+	return func(k *Kittla) {
+		k.caps = capsOf(caps)
+	}
+}
+
+// The union of caps.
+func capsOf(caps []Capability) Capability {
+	res := CAP_NONE
+	for _, c := range caps {
+		res |= c
+	}
+	return res
+}
+
+// WithContext sets the context passed to bound Go functions taking a context.Context. Commands
+// waiting on channels or tasks fail when it is cancelled.
+func WithContext(ctx context.Context) Option {
+	return func(k *Kittla) {
+		k.ctx = ctx
+	}
+}
+
+// Makes c the command name, unless it needs capabilities k doesn't have. It is remembered as
+// denied then.
+func (k *Kittla) setAllowed(name string, c *command) {
+	if missing := c.caps &^ k.caps; missing != 0 {
+		k.denied[name] |= missing
+		return
+	}
+	k.commands[name] = []*command{c}
+}
+
+// Removes the commands needing capabilities k doesn't have, remembering them as denied.
+func (k *Kittla) dropDenied() {
+	for name, cmds := range k.commands {
+		allowed := cmds[:0:0]
+		for _, c := range cmds {
+			if missing := c.caps &^ k.caps; missing != 0 {
+				k.denied[name] |= missing
+			} else {
+				allowed = append(allowed, c)
+			}
+		}
+		if len(allowed) == 0 {
+			delete(k.commands, name)
+		} else {
+			k.commands[name] = allowed
+		}
+	}
+}
+
+func (k *Kittla) permissionError(name string) error {
+	return fmt.Errorf("%s: permission denied, needs capability %s. Line: %d", name, k.denied[name], k.currLine)
+}
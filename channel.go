@@ -0,0 +1,305 @@
+package kittla
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A channel is an open file, or one of stdin, stdout and stderr. Scripts refer to channels by
+// their name, like file3.
+type channel struct {
+	name   string
+	file   *os.File
+	r      *bufio.Reader // nil unless opened for reading
+	w      *bufio.Writer // nil unless opened for writing
+	eof    bool          // Set when a read hits the end of the file
+	std    bool          // stdin, stdout or stderr, never closed for real
+	closed bool
+}
+
+// Standard input is read through one reader shared by all interpreters, as a reader of its own
+// would buffer input ahead that the others then miss. stdinMu serializes its use.
+var (
+	stdinMu     sync.Mutex
+	stdinReader = bufio.NewReader(os.Stdin)
+)
+
+func newChannel(name string, file *os.File, read, write, std bool) *channel {
+	c := &channel{name: name, file: file, std: std}
+	if read && file == os.Stdin {
+		c.r = stdinReader
+	} else if read {
+		c.r = bufio.NewReader(file)
+	}
+	if write {
+		c.w = bufio.NewWriter(file)
+	}
+	return c
+}
+
+// Predefined channels of a new interpreter.
+func stdChannels() map[string]*channel {
+	return map[string]*channel{
+		"stdin":  newChannel("stdin", os.Stdin, true, false, true),
+		"stdout": newChannel("stdout", os.Stdout, false, true, true),
+		"stderr": newChannel("stderr", os.Stderr, false, true, true),
+	}
+}
+
+func (c *channel) write(b []byte) error {
+	if c.w == nil {
+		return fmt.Errorf("channel %s wasn't opened for writing", c.name)
+	}
+	if _, err := c.w.Write(b); err != nil {
+		return err
+	}
+	// Standard output and error aren't buffered, to keep them in order with other output
+	if c.std {
+		return c.w.Flush()
+	}
+	return nil
+}
+
+// Locks the reader of c, if shared, until the returned function is called.
+func (c *channel) lockReader() func() {
+	if c.r != stdinReader {
+		return func() {}
+	}
+	stdinMu.Lock()
+	return stdinMu.Unlock
+}
+
+func (c *channel) flush() error {
+	if c.w == nil {
+		return nil
+	}
+	return c.w.Flush()
+}
+
+// Returns the channel o refers to, a channel value or the name of an open channel.
+func (k *Kittla) channel(o *obj) (*channel, error) {
+	c := o.valChan
+	if o.valType != valTypeChan {
+		c = k.channels[o.toString()]
+	}
+	if c == nil || c.closed {
+		return nil, fmt.Errorf("can not find channel named \"%s\"", o.toString())
+	}
+	return c, nil
+}
+
+func (k *Kittla) closeChannel(c *channel) error {
+	err := c.flush()
+	if !c.std {
+		if cerr := c.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	c.closed = true
+	delete(k.channels, c.name)
+	return err
+}
+
+// Tcl style access modes, r, r+, w, w+, a and a+.
+var openModes = map[string]struct {
+	flag        int
+	read, write bool
+}{
+	"r":  {os.O_RDONLY, true, false},
+	"r+": {os.O_RDWR, true, true},
+	"w":  {os.O_WRONLY | os.O_CREATE | os.O_TRUNC, false, true},
+	"w+": {os.O_RDWR | os.O_CREATE | os.O_TRUNC, true, true},
+	"a":  {os.O_WRONLY | os.O_CREATE | os.O_APPEND, false, true},
+	"a+": {os.O_RDWR | os.O_CREATE | os.O_APPEND, true, true},
+}
+
+// open path ?mode?
+func cmdOpen(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	mode := "r"
+	if len(args) == 2 {
+		mode = args[1].toString()
+	}
+	m, present := openModes[mode]
+	if !present {
+		return nil, fmt.Errorf("%s: bad mode %s, must be r, r+, w, w+, a or a+. Line: %d", cmd, mode, k.currLine)
+	}
+
+	f, err := os.OpenFile(args[0].toString(), m.flag, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+
+	c := newChannel("file"+strconv.Itoa(k.nextChanId), f, m.read, m.write, false)
+	k.nextChanId++
+	k.channels[c.name] = c
+	return &obj{valType: valTypeChan, valChan: c}, nil
+}
+
+func cmdClose(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	c, err := k.channel(args[0])
+	if err == nil {
+		err = k.closeChannel(c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	return nil, nil
+}
+
+func cmdEof(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	c, err := k.channel(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	return &obj{valType: valTypeBool, valBool: c.eof}, nil
+}
+
+func cmdFlush(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	c, err := k.channel(args[0])
+	if err == nil {
+		err = c.flush()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	return nil, nil
+}
+
+// gets chan ?var?
+// Reads a line, without the line ending. With var, the line is stored in var and the length of
+// the line is returned, -1 at end of file.
+func cmdGets(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	c, err := k.channel(args[0])
+	if err == nil && c.r == nil {
+		err = fmt.Errorf("channel %s wasn't opened for reading", c.name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+
+	defer c.lockReader()()
+
+	line, err := c.r.ReadString('\n')
+	if err == io.EOF {
+		c.eof = true
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	gotLine := !c.eof || len(line) > 0
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+	if len(args) == 1 {
+		return &obj{valType: valTypeStr, valStr: []byte(line)}, nil
+	}
+	if err := k.setVar(args[1].toString(), &obj{valType: valTypeStr, valStr: []byte(line)}); err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	if !gotLine {
+		return &obj{valType: valTypeInt, valInt: -1}, nil
+	}
+	return &obj{valType: valTypeInt, valInt: len(line)}, nil
+}
+
+// read chan ?n?
+// Reads n bytes, or everything up to the end of the file.
+func cmdRead(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	c, err := k.channel(args[0])
+	if err == nil && c.r == nil {
+		err = fmt.Errorf("channel %s wasn't opened for reading", c.name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+
+	defer c.lockReader()()
+
+	var data []byte
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].toString())
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s: bad count %s. Line: %d", cmd, args[1].toString(), k.currLine)
+		}
+		data = make([]byte, n)
+		n, err = io.ReadFull(c.r, data)
+		data = data[:n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+	} else {
+		if data, err = io.ReadAll(c.r); err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+		c.eof = true
+	}
+	return &obj{valType: valTypeStr, valStr: data}, nil
+}
+
+// seek chan offset ?start|current|end?
+func cmdSeek(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	c, err := k.channel(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	offset, err := strconv.ParseInt(args[1].toString(), 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad offset %s. Line: %d", cmd, args[1].toString(), k.currLine)
+	}
+
+	defer c.lockReader()()
+
+	whence := io.SeekStart
+	if len(args) == 3 {
+		switch args[2].toString() {
+		case "start":
+		case "current":
+			whence = io.SeekCurrent
+			// The file position is ahead of the reader by what is buffered
+			if c.r != nil {
+				offset -= int64(c.r.Buffered())
+			}
+		case "end":
+			whence = io.SeekEnd
+		default:
+			return nil, fmt.Errorf("%s: bad origin %s, must be start, current or end. Line: %d", cmd, args[2].toString(), k.currLine)
+		}
+	}
+
+	if err := c.flush(); err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	if _, err := c.file.Seek(offset, whence); err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	if c.r != nil {
+		c.r.Reset(c.file)
+	}
+	c.eof = false
+	return nil, nil
+}
+
+func cmdTell(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	c, err := k.channel(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	defer c.lockReader()()
+
+	pos, err := c.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return &obj{valType: valTypeInt, valInt: -1}, nil
+	}
+	if c.r != nil {
+		pos -= int64(c.r.Buffered())
+	}
+	if c.w != nil {
+		pos += int64(c.w.Buffered())
+	}
+	return &obj{valType: valTypeInt, valInt: int(pos)}, nil
+}
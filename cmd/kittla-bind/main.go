@@ -0,0 +1,291 @@
+// kittla-bind generates kittla commands calling Go functions, without reflection. Functions are
+// picked by a comment in their documentation:
+//
+//	//kittla:command ?name?
+//	func SetVolume(level int, channels ...string) error
+//
+// The name defaults to the function name with a lower case first letter. Parameters can be int,
+// int64, float64, bool, string, slices of them, a variadic of them, pointers passed as handles and
+// a leading context.Context. Results can be anything, optionally followed by an error.
+//
+// The generated file holds a table of kittla.Command, registered with k.Register(kittlaCommands).
+// Typically run by go generate:
+//
+//	//go:generate kittla-bind -o commands_kittla.go
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const directive = "//kittla:command"
+
+var argTypes = map[string]bool{"int": true, "int64": true, "float64": true, "bool": true, "string": true}
+
+// A function to make a command of
+type binding struct {
+	name     string // Command name
+	fn       string // Go function name
+	ctx      bool   // Takes a context.Context first
+	params   []string
+	variadic bool   // The last parameter is variadic
+	results  int    // Number of results, not counting a trailing error
+	hasErr   bool   // Trailing error result
+	pos      string // Position in the source, for error messages
+}
+
+// Element type of a parameter type, and whether it is a slice.
+func paramType(expr ast.Expr) (string, bool, bool) {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return t.Name, false, argTypes[t.Name]
+	case *ast.StarExpr:
+		return types.ExprString(t), false, true
+	case *ast.ArrayType:
+		if elem, ok := t.Elt.(*ast.Ident); ok && t.Len == nil {
+			return elem.Name, true, argTypes[elem.Name]
+		}
+	case *ast.Ellipsis:
+		if elem, ok := t.Elt.(*ast.Ident); ok {
+			return elem.Name, false, argTypes[elem.Name]
+		}
+	}
+	return "", false, false
+}
+
+func isContext(expr ast.Expr) bool {
+	sel, ok := expr.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	pkg, ok := sel.X.(*ast.Ident)
+	return ok && pkg.Name == "context" && sel.Sel.Name == "Context"
+}
+
+func isError(expr ast.Expr) bool {
+	id, ok := expr.(*ast.Ident)
+	return ok && id.Name == "error"
+}
+
+func commandName(doc *ast.CommentGroup, fn string) (string, bool) {
+	if doc == nil {
+		return "", false
+	}
+	for _, c := range doc.List {
+		if !strings.HasPrefix(c.Text, directive) {
+			continue
+		}
+		if name := strings.TrimSpace(strings.TrimPrefix(c.Text, directive)); name != "" {
+			return name, true
+		}
+		r, size := utf8.DecodeRuneInString(fn)
+		return string(unicode.ToLower(r)) + fn[size:], true
+	}
+	return "", false
+}
+
+func parseBinding(fset *token.FileSet, fd *ast.FuncDecl) (*binding, error) {
+	name, ok := commandName(fd.Doc, fd.Name.Name)
+	if !ok {
+		return nil, nil
+	}
+
+	b := &binding{name: name, fn: fd.Name.Name, pos: fset.Position(fd.Pos()).String()}
+	if fd.Recv != nil || fd.Type.TypeParams != nil {
+		return nil, fmt.Errorf("%s: %s must be a plain function", b.pos, b.fn)
+	}
+
+	for i, field := range fd.Type.Params.List {
+		if i == 0 && isContext(field.Type) {
+			b.ctx = true
+			continue
+		}
+		typ, slice, ok := paramType(field.Type)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s: unsupported parameter type", fset.Position(field.Pos()), b.fn)
+		}
+		if slice {
+			typ = "[]" + typ
+		}
+		if _, variadic := field.Type.(*ast.Ellipsis); variadic {
+			b.variadic = true
+		}
+		n := len(field.Names)
+		if n == 0 {
+			n = 1
+		}
+		for j := 0; j < n; j++ {
+			b.params = append(b.params, typ)
+		}
+	}
+
+	if fd.Type.Results != nil {
+		for _, field := range fd.Type.Results.List {
+			n := len(field.Names)
+			if n == 0 {
+				n = 1
+			}
+			b.results += n
+		}
+		last := fd.Type.Results.List[len(fd.Type.Results.List)-1]
+		if isError(last.Type) {
+			b.hasErr = true
+			b.results--
+		}
+	}
+	if b.results > 1 {
+		return nil, fmt.Errorf("%s: %s: at most one result besides an error is supported", b.pos, b.fn)
+	}
+	return b, nil
+}
+
+// Writes the wrapper calling b.fn.
+func (b *binding) wrapper(w *bytes.Buffer) {
+	fmt.Fprintf(w, "func kittla%s(k *kittla.Kittla, args kittla.Args) (any, error) {\n", b.fn)
+
+	callArgs := make([]string, 0, len(b.params)+1)
+	if b.ctx {
+		callArgs = append(callArgs, "args.Context()")
+	}
+	for i, typ := range b.params {
+		arg := fmt.Sprintf("a%d", i)
+		switch {
+		case b.variadic && i == len(b.params)-1:
+			fmt.Fprintf(w, "\tvar %s []%s\n", arg, typ)
+			fmt.Fprintf(w, "\tfor i := %d; i < args.Len(); i++ {\n", i)
+			fmt.Fprintf(w, "\t\tv, err := kittla.Arg[%s](args, i)\n", typ)
+			fmt.Fprintf(w, "\t\tif err != nil {\n\t\t\treturn nil, err\n\t\t}\n")
+			fmt.Fprintf(w, "\t\t%s = append(%s, v)\n\t}\n", arg, arg)
+			arg += "..."
+		case strings.HasPrefix(typ, "*"):
+			fmt.Fprintf(w, "\t%s, err := kittla.HandleArg[%s](args, %d)\n", arg, typ, i)
+			fmt.Fprintf(w, "\tif err != nil {\n\t\treturn nil, err\n\t}\n")
+		case strings.HasPrefix(typ, "[]"):
+			fmt.Fprintf(w, "\t%s, err := kittla.ListArg[%s](args, %d)\n", arg, typ[2:], i)
+			fmt.Fprintf(w, "\tif err != nil {\n\t\treturn nil, err\n\t}\n")
+		default:
+			fmt.Fprintf(w, "\t%s, err := kittla.Arg[%s](args, %d)\n", arg, typ, i)
+			fmt.Fprintf(w, "\tif err != nil {\n\t\treturn nil, err\n\t}\n")
+		}
+		callArgs = append(callArgs, arg)
+	}
+
+	call := fmt.Sprintf("%s(%s)", b.fn, strings.Join(callArgs, ", "))
+	switch {
+	case b.results == 1 && b.hasErr:
+		fmt.Fprintf(w, "\treturn %s\n", call)
+	case b.results == 1:
+		fmt.Fprintf(w, "\treturn %s, nil\n", call)
+	case b.hasErr:
+		fmt.Fprintf(w, "\treturn nil, %s\n", call)
+	default:
+		fmt.Fprintf(w, "\t%s\n\treturn nil, nil\n", call)
+	}
+	fmt.Fprintf(w, "}\n\n")
+}
+
+func (b *binding) arity() (int, int) {
+	n := len(b.params)
+	if b.variadic {
+		return n - 1, -1
+	}
+	return n, n
+}
+
+func generate(pkg string, bindings []*binding, table, importPath string) ([]byte, error) {
+	var w bytes.Buffer
+
+	fmt.Fprintf(&w, "// Code generated by kittla-bind. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&w, "package %s\n\nimport \"%s\"\n\n", pkg, importPath)
+
+	for _, b := range bindings {
+		b.wrapper(&w)
+	}
+
+	fmt.Fprintf(&w, "var %s = []kittla.Command{\n", table)
+	for _, b := range bindings {
+		min, max := b.arity()
+		fmt.Fprintf(&w, "\t{\n\t\tNames:   []string{%q},\n\t\tMinArgs: %d,\n\t\tMaxArgs: %d,\n\t\tFn:      kittla%s,\n\t},\n",
+			b.name, min, max, b.fn)
+	}
+	fmt.Fprintf(&w, "}\n")
+
+	return format.Source(w.Bytes())
+}
+
+// Finds the marked functions in files, skipping tests and output. Returns the package name and
+// the bindings, sorted by name.
+func parseFiles(files []string, output string) (string, []*binding, error) {
+	fset := token.NewFileSet()
+	pkg := ""
+	bindings := make([]*binding, 0, 16)
+
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") || filepath.Base(file) == filepath.Base(output) {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, parser.ParseComments)
+		if err != nil {
+			return "", nil, err
+		}
+		pkg = f.Name.Name
+		for _, decl := range f.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok {
+				continue
+			}
+			b, err := parseBinding(fset, fd)
+			if err != nil {
+				return "", nil, err
+			}
+			if b != nil {
+				bindings = append(bindings, b)
+			}
+		}
+	}
+	if len(bindings) == 0 {
+		return "", nil, fmt.Errorf("no functions marked with %s", directive)
+	}
+	sort.Slice(bindings, func(i, j int) bool { return bindings[i].name < bindings[j].name })
+	return pkg, bindings, nil
+}
+
+func main() {
+	var output, table, importPath string
+
+	flag.StringVar(&output, "o", "kittla_commands.go", "File to generate.")
+	flag.StringVar(&table, "var", "kittlaCommands", "Name of the generated command table.")
+	flag.StringVar(&importPath, "import", "kittla", "Import path of kittla.")
+	flag.Parse()
+
+	files := flag.Args()
+	if len(files) == 0 {
+		files, _ = filepath.Glob("*.go")
+	}
+
+	pkg, bindings, err := parseFiles(files, output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	src, err := generate(pkg, bindings, table, importPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(output, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
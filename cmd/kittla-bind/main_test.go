@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden file.")
+
+const fixtureDir = "testdata/fixture"
+
+func TestGenerate(t *testing.T) {
+	golden := filepath.Join(fixtureDir, "kittla_commands.go")
+	files, _ := filepath.Glob(filepath.Join(fixtureDir, "*.go"))
+
+	pkg, bindings, err := parseFiles(files, golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := generate(pkg, bindings, "kittlaCommands", "kittla")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *update {
+		if err := os.WriteFile(golden, src, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, want) {
+		t.Errorf("Generated code differs from %s, run go test -update to see the difference in git:\n%s", golden, src)
+	}
+}
+
+// The golden file must compile, with the kittla functions it calls.
+func TestGeneratedBuilds(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Runs go build")
+	}
+	gocmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("No go command")
+	}
+	if out, err := exec.Command(gocmd, "build", "./"+fixtureDir).CombinedOutput(); err != nil {
+		t.Errorf("go build failed: %v\n%s", err, out)
+	}
+}
+
+func TestParseBinding(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		fail bool
+	}{
+		{src: "//kittla:command\nfunc F(a, b int, c []string) (float64, error)"},
+		{src: "//kittla:command\nfunc (s *S) F()", fail: true},
+		{src: "//kittla:command\nfunc F[T any](t T)", fail: true},
+		{src: "//kittla:command\nfunc F(m map[string]int)", fail: true},
+		{src: "//kittla:command\nfunc F() (int, string)", fail: true},
+	} {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "f.go", "package p\n"+tc.src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := parseBinding(fset, f.Decls[0].(*ast.FuncDecl))
+		switch {
+		case tc.fail && err == nil:
+			t.Errorf("%s didn't fail", tc.src)
+		case !tc.fail && err != nil:
+			t.Errorf("%s: %v", tc.src, err)
+		case !tc.fail:
+			if min, max := b.arity(); b.name != "f" || min != 3 || max != 3 || !b.hasErr || b.results != 1 {
+				t.Errorf("%s: parsed as %+v", tc.src, b)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Package fixture has functions marked for kittla-bind, compared with the golden
+// kittla_commands.go by the tests.
+package fixture
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+type Conn struct {
+	Addr string
+	sent []string
+}
+
+//kittla:command
+func Dial(addr string) *Conn {
+	return &Conn{Addr: addr}
+}
+
+//kittla:command send
+func Write(ctx context.Context, c *Conn, data string, repeat ...int) (int, error) {
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	n := 1
+	for _, r := range repeat {
+		n *= r
+	}
+	for i := 0; i < n; i++ {
+		c.sent = append(c.sent, data)
+	}
+	return n, nil
+}
+
+//kittla:command
+func Sum(nums []float64) float64 {
+	s := 0.0
+	for _, n := range nums {
+		s += n
+	}
+	return s
+}
+
+//kittla:command
+func Check(ok bool) error {
+	if !ok {
+		return errors.New("not ok")
+	}
+	return nil
+}
+
+//kittla:command
+func Hangup(c *Conn) {
+	c.sent = nil
+}
+
+// Not marked, so left out
+func Upper(s string) string {
+	return strings.ToUpper(s)
+}
@@ -0,0 +1,91 @@
+// Code generated by kittla-bind. DO NOT EDIT.
+
+package fixture
+
+import "kittla"
+
+func kittlaCheck(k *kittla.Kittla, args kittla.Args) (any, error) {
+	a0, err := kittla.Arg[bool](args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return nil, Check(a0)
+}
+
+func kittlaDial(k *kittla.Kittla, args kittla.Args) (any, error) {
+	a0, err := kittla.Arg[string](args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return Dial(a0), nil
+}
+
+func kittlaHangup(k *kittla.Kittla, args kittla.Args) (any, error) {
+	a0, err := kittla.HandleArg[*Conn](args, 0)
+	if err != nil {
+		return nil, err
+	}
+	Hangup(a0)
+	return nil, nil
+}
+
+func kittlaWrite(k *kittla.Kittla, args kittla.Args) (any, error) {
+	a0, err := kittla.HandleArg[*Conn](args, 0)
+	if err != nil {
+		return nil, err
+	}
+	a1, err := kittla.Arg[string](args, 1)
+	if err != nil {
+		return nil, err
+	}
+	var a2 []int
+	for i := 2; i < args.Len(); i++ {
+		v, err := kittla.Arg[int](args, i)
+		if err != nil {
+			return nil, err
+		}
+		a2 = append(a2, v)
+	}
+	return Write(args.Context(), a0, a1, a2...)
+}
+
+func kittlaSum(k *kittla.Kittla, args kittla.Args) (any, error) {
+	a0, err := kittla.ListArg[float64](args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return Sum(a0), nil
+}
+
+var kittlaCommands = []kittla.Command{
+	{
+		Names:   []string{"check"},
+		MinArgs: 1,
+		MaxArgs: 1,
+		Fn:      kittlaCheck,
+	},
+	{
+		Names:   []string{"dial"},
+		MinArgs: 1,
+		MaxArgs: 1,
+		Fn:      kittlaDial,
+	},
+	{
+		Names:   []string{"hangup"},
+		MinArgs: 1,
+		MaxArgs: 1,
+		Fn:      kittlaHangup,
+	},
+	{
+		Names:   []string{"send"},
+		MinArgs: 2,
+		MaxArgs: -1,
+		Fn:      kittlaWrite,
+	},
+	{
+		Names:   []string{"sum"},
+		MinArgs: 1,
+		MaxArgs: 1,
+		Fn:      kittlaSum,
+	},
+}
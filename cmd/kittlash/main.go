@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"kittla"
 	"log"
 	"os"
@@ -53,7 +52,7 @@ func interactive() {
 
 	line.SetCtrlCAborts(true)
 
-	k := kittla.New()
+	k := newKittla(".")
 
 	// TODO: struct with shell commands and functions.
 	shcmds := []string{"/help", "/quit", "/reset"}
@@ -83,7 +82,7 @@ mainloop:
 				continue mainloop
 			case "/reset":
 				fmt.Println(" -- Reset kittla instance")
-				k = kittla.New()
+				k = newKittla(".")
 				prog.Reset()
 				continue mainloop
 			case "/quit":
@@ -96,6 +95,7 @@ mainloop:
 			prog.WriteString(";")
 
 			if depth := k.GetNumUnclosed(prog.String()); depth == 0 {
+				k.RunPending()
 				if res, lastFunc, err := k.Execute(prog.String()); err == nil {
 					if lastFunc != kittla.CMD_PRINT {
 						fmt.Println(string(res))
@@ -125,8 +125,19 @@ mainloop:
 
 }
 
-func execute(prog string) {
-	if res, lastFunc, err := kittla.New().Execute(prog); err == nil {
+// A kittla instance searching for packages in KITTLAPATH and then in dir.
+func newKittla(dir string) *kittla.Kittla {
+	k := kittla.New()
+	k.SetModulePath(append(kittla.ModulePathFromEnv(), dir)...)
+	return k
+}
+
+// Reports the result of a script, once the scripts it scheduled with after have run.
+func report(k *kittla.Kittla, res []byte, lastFunc kittla.CmdID, err error) {
+	if err == nil {
+		err = k.RunEvents()
+	}
+	if err == nil {
 		if lastFunc != kittla.CMD_PRINT {
 			fmt.Println(string(res))
 		}
@@ -145,16 +156,20 @@ func main() {
 	flag.Parse()
 
 	if len(prog) > 0 {
-		execute(prog)
+		k := newKittla(".")
+		res, lastFunc, err := k.Execute(prog)
+		report(k, res, lastFunc, err)
 	} else if len(flag.Args()) == 0 {
 		interactive()
 	} else if len(flag.Args()) == 1 {
-		if d, err := ioutil.ReadFile(flag.Args()[0]); err == nil {
-			execute(string(d))
-		} else {
+		file := flag.Args()[0]
+		if _, err := os.Stat(file); err != nil {
 			fmt.Println("Failed to read given file:", err)
 			os.Exit(1)
 		}
+		k := newKittla(filepath.Dir(file))
+		res, lastFunc, err := k.ExecuteFile(file)
+		report(k, res, lastFunc, err)
 
 	} else {
 		fmt.Println("Too many arguments.")
@@ -3,6 +3,7 @@ package kittla
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/tidwall/expr"
 )
@@ -27,6 +28,49 @@ const (
 	CMD_UNKNOWN
 	CMD_VAR
 	CMD_WHILE
+	CMD_GLOBAL
+	CMD_UPLEVEL
+	CMD_UPVAR
+	CMD_LOCAL
+	CMD_APPLY
+	CMD_MAP
+	CMD_FILTER
+	CMD_REDUCE
+	CMD_SORT
+	CMD_CURRY
+	CMD_INFO
+	CMD_UNSET
+	CMD_RENAME
+	CMD_ALIAS
+	CMD_NAMESPACE
+	CMD_VARIABLE
+	CMD_ENSEMBLE
+	CMD_SOURCE
+	CMD_PACKAGE
+	CMD_OPEN
+	CMD_CLOSE
+	CMD_GETS
+	CMD_READ
+	CMD_FLUSH
+	CMD_SEEK
+	CMD_TELL
+	CMD_EOF
+	CMD_FILE
+	CMD_GLOB
+	CMD_INTERP
+	CMD_CHAN
+	CMD_SELECT
+	CMD_ON
+	CMD_OFF
+	CMD_AFTER
+	CMD_UPDATE
+	CMD_VWAIT
+	CMD_GO
+	CMD_WAIT
+	CMD_COROUTINE
+	CMD_YIELD
+	CMD_GENERATOR
+	CMD_FOREACH
 
 	CMD_END_OF_BUILT_IN
 )
@@ -39,11 +83,58 @@ type command struct {
 	fn      func(*Kittla, CmdID, string, []*obj) (*obj, error)
 
 	// For commands in kittla
-	args []*obj
-	body *obj
+	params  []*param
+	result  string // Type of the result, "" if not declared
+	body    *obj
+	closure *frame     // Frame where an anonymous command was created
+	ns      *namespace // Namespace the command was created in
+
+	ensemble ensemble   // Subcommands, if the command is an ensemble
+	caps     Capability // Capabilities needed to use the command
+	alias    string     // Command an alias calls, for finding alias loops
+}
+
+// Parameter of a command defined with fn
+type param struct {
+	name  string
+	def   *obj   // Default value, nil if the parameter must be given
+	named bool   // Named option, given as -name value
+	rest  bool   // Trailing args, collects the remaining arguments as a list
+	typ   string // Declared type, "" if not declared
+}
+
+func (c *command) namedParam(name string) *param {
+	for _, p := range c.params {
+		if p.named && p.name == name {
+			return p
+		}
+	}
+	return nil
 }
 
 var builtinCommands = []command{
+	{
+		names:   []string{"after"},
+		minArgs: 1,
+		maxArgs: -1,
+		id:      CMD_AFTER,
+		fn:      cmdAfter,
+		caps:    CAP_TIME,
+	},
+	{
+		names:   []string{"alias"},
+		minArgs: 2,
+		maxArgs: -1,
+		id:      CMD_ALIAS,
+		fn:      cmdAlias,
+	},
+	{
+		names:   []string{"apply"},
+		minArgs: 1,
+		maxArgs: -1,
+		id:      CMD_APPLY,
+		fn:      cmdApply,
+	},
 	{
 		names:   []string{"break"},
 		minArgs: 0,
@@ -51,6 +142,21 @@ var builtinCommands = []command{
 		id:      CMD_BREAK,
 		fn:      cmdBreakContinue,
 	},
+	{
+		names:    []string{"chan"},
+		minArgs:  1,
+		maxArgs:  -1,
+		id:       CMD_CHAN,
+		fn:       chanEnsemble.dispatch,
+		ensemble: chanEnsemble,
+	},
+	{
+		names:   []string{"close"},
+		minArgs: 1,
+		maxArgs: 1,
+		id:      CMD_CLOSE,
+		fn:      cmdClose,
+	},
 	{
 		names:   []string{"continue"},
 		minArgs: 0,
@@ -58,6 +164,20 @@ var builtinCommands = []command{
 		id:      CMD_CONTINUE,
 		fn:      cmdBreakContinue,
 	},
+	{
+		names:   []string{"coroutine"},
+		minArgs: 2,
+		maxArgs: -1,
+		id:      CMD_COROUTINE,
+		fn:      cmdCoroutine,
+	},
+	{
+		names:   []string{"curry"},
+		minArgs: 1,
+		maxArgs: -1,
+		id:      CMD_CURRY,
+		fn:      cmdCurry,
+	},
 	{
 		names:   []string{"dec", "decr"},
 		minArgs: 1,
@@ -79,6 +199,21 @@ var builtinCommands = []command{
 		id:      CMD_ELSE,
 		fn:      cmdElse,
 	},
+	{
+		names:    []string{"ensemble"},
+		minArgs:  1,
+		maxArgs:  -1,
+		id:       CMD_ENSEMBLE,
+		fn:       ensembleEnsemble.dispatch,
+		ensemble: ensembleEnsemble,
+	},
+	{
+		names:   []string{"eof"},
+		minArgs: 1,
+		maxArgs: 1,
+		id:      CMD_EOF,
+		fn:      cmdEof,
+	},
 	{
 		names:   []string{"eval", "expr"},
 		minArgs: 1,
@@ -86,6 +221,22 @@ var builtinCommands = []command{
 		id:      CMD_EVAL,
 		fn:      cmdEval,
 	},
+	{
+		names:    []string{"file"},
+		minArgs:  1,
+		maxArgs:  -1,
+		id:       CMD_FILE,
+		fn:       fileEnsemble.dispatch,
+		ensemble: fileEnsemble,
+		caps:     CAP_FS,
+	},
+	{
+		names:   []string{"filter"},
+		minArgs: 2,
+		maxArgs: 2,
+		id:      CMD_FILTER,
+		fn:      cmdFilter,
+	},
 	{
 		names:   []string{"float"},
 		minArgs: 1,
@@ -93,13 +244,63 @@ var builtinCommands = []command{
 		id:      CMD_FLOAT,
 		fn:      cmdFloat,
 	},
+	{
+		names:   []string{"flush"},
+		minArgs: 1,
+		maxArgs: 1,
+		id:      CMD_FLUSH,
+		fn:      cmdFlush,
+	},
 	{
 		names:   []string{"fn"},
 		minArgs: 2,
-		maxArgs: 3,
+		maxArgs: 5,
 		id:      CMD_FN,
 		fn:      cmdFn,
 	},
+	{
+		names:   []string{"foreach"},
+		minArgs: 3,
+		maxArgs: 3,
+		id:      CMD_FOREACH,
+		fn:      cmdForeach,
+	},
+	{
+		names:   []string{"generator"},
+		minArgs: 1,
+		maxArgs: -1,
+		id:      CMD_GENERATOR,
+		fn:      cmdGenerator,
+	},
+	{
+		names:   []string{"gets"},
+		minArgs: 1,
+		maxArgs: 2,
+		id:      CMD_GETS,
+		fn:      cmdGets,
+	},
+	{
+		names:   []string{"glob"},
+		minArgs: 1,
+		maxArgs: -1,
+		id:      CMD_GLOB,
+		fn:      cmdGlob,
+		caps:    CAP_FS,
+	},
+	{
+		names:   []string{"global"},
+		minArgs: 0,
+		maxArgs: -1,
+		id:      CMD_GLOBAL,
+		fn:      cmdGlobal,
+	},
+	{
+		names:   []string{"go"},
+		minArgs: 1,
+		maxArgs: 1,
+		id:      CMD_GO,
+		fn:      cmdGo,
+	},
 	{
 		names:   []string{"if"},
 		minArgs: 2,
@@ -114,6 +315,14 @@ var builtinCommands = []command{
 		id:      CMD_INC,
 		fn:      cmdIncDec,
 	},
+	{
+		names:    []string{"info"},
+		minArgs:  1,
+		maxArgs:  -1,
+		id:       CMD_INFO,
+		fn:       infoEnsemble.dispatch,
+		ensemble: infoEnsemble,
+	},
 	{
 		names:   []string{"int"},
 		minArgs: 1,
@@ -121,6 +330,21 @@ var builtinCommands = []command{
 		id:      CMD_INT,
 		fn:      cmdInt,
 	},
+	{
+		names:    []string{"interp"},
+		minArgs:  1,
+		maxArgs:  -1,
+		id:       CMD_INTERP,
+		fn:       interpEnsemble.dispatch,
+		ensemble: interpEnsemble,
+	},
+	{
+		names:   []string{"local"},
+		minArgs: 1,
+		maxArgs: 2,
+		id:      CMD_LOCAL,
+		fn:      cmdLocal,
+	},
 	{
 		names:   []string{"loop"},
 		minArgs: 1,
@@ -128,13 +352,80 @@ var builtinCommands = []command{
 		id:      CMD_LOOP,
 		fn:      cmdLoop,
 	},
+	{
+		names:   []string{"map"},
+		minArgs: 2,
+		maxArgs: 2,
+		id:      CMD_MAP,
+		fn:      cmdMap,
+	},
+	{
+		names:    []string{"namespace"},
+		minArgs:  1,
+		maxArgs:  -1,
+		id:       CMD_NAMESPACE,
+		fn:       namespaceEnsemble.dispatch,
+		ensemble: namespaceEnsemble,
+	},
+	{
+		names:   []string{"off"},
+		minArgs: 1,
+		maxArgs: 2,
+		id:      CMD_OFF,
+		fn:      cmdOff,
+	},
+	{
+		names:   []string{"on"},
+		minArgs: 3,
+		maxArgs: 3,
+		id:      CMD_ON,
+		fn:      cmdOn,
+	},
+	{
+		names:   []string{"open"},
+		minArgs: 1,
+		maxArgs: 2,
+		id:      CMD_OPEN,
+		fn:      cmdOpen,
+		caps:    CAP_FS,
+	},
+	{
+		names:    []string{"package"},
+		minArgs:  1,
+		maxArgs:  -1,
+		id:       CMD_PACKAGE,
+		fn:       packageEnsemble.dispatch,
+		ensemble: packageEnsemble,
+		caps:     CAP_FS,
+	},
 	{
 		names:   []string{"print", "puts"},
 		minArgs: 0,
-		maxArgs: 1,
+		maxArgs: 3,
 		id:      CMD_PRINT,
 		fn:      cmdPrint,
 	},
+	{
+		names:   []string{"read"},
+		minArgs: 1,
+		maxArgs: 2,
+		id:      CMD_READ,
+		fn:      cmdRead,
+	},
+	{
+		names:   []string{"reduce"},
+		minArgs: 3,
+		maxArgs: 3,
+		id:      CMD_REDUCE,
+		fn:      cmdReduce,
+	},
+	{
+		names:   []string{"rename"},
+		minArgs: 2,
+		maxArgs: 2,
+		id:      CMD_RENAME,
+		fn:      cmdRename,
+	},
 	{
 		names:   []string{"return"},
 		minArgs: 0,
@@ -142,6 +433,42 @@ var builtinCommands = []command{
 		id:      CMD_RETURN,
 		fn:      cmdReturn,
 	},
+	{
+		names:   []string{"seek"},
+		minArgs: 2,
+		maxArgs: 3,
+		id:      CMD_SEEK,
+		fn:      cmdSeek,
+	},
+	{
+		names:   []string{"select"},
+		minArgs: 1,
+		maxArgs: 1,
+		id:      CMD_SELECT,
+		fn:      cmdSelect,
+	},
+	{
+		names:   []string{"sort"},
+		minArgs: 1,
+		maxArgs: 4,
+		id:      CMD_SORT,
+		fn:      cmdSort,
+	},
+	{
+		names:   []string{"source"},
+		minArgs: 1,
+		maxArgs: 1,
+		id:      CMD_SOURCE,
+		fn:      cmdSource,
+		caps:    CAP_FS,
+	},
+	{
+		names:   []string{"tell"},
+		minArgs: 1,
+		maxArgs: 1,
+		id:      CMD_TELL,
+		fn:      cmdTell,
+	},
 
 	{
 		names:   []string{"unknown"},
@@ -150,6 +477,34 @@ var builtinCommands = []command{
 		id:      CMD_UNKNOWN,
 		fn:      cmdUnknown,
 	},
+	{
+		names:   []string{"unset"},
+		minArgs: 1,
+		maxArgs: -1,
+		id:      CMD_UNSET,
+		fn:      cmdUnset,
+	},
+	{
+		names:   []string{"update"},
+		minArgs: 0,
+		maxArgs: 0,
+		id:      CMD_UPDATE,
+		fn:      cmdUpdate,
+	},
+	{
+		names:   []string{"uplevel"},
+		minArgs: 1,
+		maxArgs: -1,
+		id:      CMD_UPLEVEL,
+		fn:      cmdUplevel,
+	},
+	{
+		names:   []string{"upvar"},
+		minArgs: 2,
+		maxArgs: -1,
+		id:      CMD_UPVAR,
+		fn:      cmdUpvar,
+	},
 	{
 		names:   []string{"var", "set"},
 		minArgs: 1,
@@ -157,6 +512,28 @@ var builtinCommands = []command{
 		id:      CMD_VAR,
 		fn:      cmdVar,
 	},
+	{
+		names:   []string{"variable"},
+		minArgs: 1,
+		maxArgs: -1,
+		id:      CMD_VARIABLE,
+		fn:      cmdVariable,
+	},
+	{
+		names:   []string{"vwait"},
+		minArgs: 1,
+		maxArgs: 1,
+		id:      CMD_VWAIT,
+		fn:      cmdVwait,
+		caps:    CAP_TIME,
+	},
+	{
+		names:   []string{"wait"},
+		minArgs: 1,
+		maxArgs: 1,
+		id:      CMD_WAIT,
+		fn:      cmdWait,
+	},
 	{
 		names:   []string{"while"},
 		minArgs: 2,
@@ -164,30 +541,108 @@ var builtinCommands = []command{
 		id:      CMD_WHILE,
 		fn:      cmdWhile,
 	},
+	{
+		names:   []string{"yield"},
+		minArgs: 0,
+		maxArgs: 1,
+		id:      CMD_YIELD,
+		fn:      cmdYield,
+	},
 }
 
-func call(k *Kittla, fn *command, cmd string, args []*obj) (*obj, error) {
+// Binds the arguments of a call to the parameters of fn in a new frame. Named options come first,
+// then the positional arguments, and last anything collected by args.
+func bindParams(k *Kittla, fn *command, cmd string, args []*obj) (*frame, error) {
 
-	k.frames = append(k.frames, k.currFrame)
-	newFrame := &frame{objects: make(map[string]*obj), prevCmd: fn.id}
+	newFrame := &frame{objects: make(map[string]*obj), prevCmd: fn.id, closure: fn.closure, ns: fn.ns,
+		call: append([]*obj{{valType: valTypeStr, valStr: []byte(cmd)}}, args...)}
+
+	hasNamed := false
+	for _, p := range fn.params {
+		if p.named {
+			hasNamed = true
+			if p.def != nil {
+				newFrame.objects[p.name] = p.def.clone()
+			}
+		}
+	}
 
 	i := 0
-	for i = 0; i < len(args); i++ {
-		a, err := k.parse(&codeBlock{code: fn.args[i].toString(), lineNum: k.currLine}, false)
-		if err != nil || len(a) == 0 {
-			return nil, fmt.Errorf("%s has a malformed argument. Line: %d", cmd, k.currLine)
+	for hasNamed && i < len(args) && args[i].valType == valTypeStr && strings.HasPrefix(args[i].toString(), "-") {
+		opt := args[i].toString()
+		if opt == "--" {
+			i++
+			break
+		}
+		p := fn.namedParam(opt[1:])
+		if p == nil {
+			return nil, fmt.Errorf("%s: unknown option %s. Line: %d", cmd, opt, k.currLine)
 		}
-		newFrame.objects[a[0].toString()] = args[i].clone()
+		if i+1 == len(args) {
+			return nil, fmt.Errorf("%s: option %s lacks value. Line: %d", cmd, opt, k.currLine)
+		}
+		newFrame.objects[p.name] = args[i+1].clone()
+		i += 2
+	}
+
+	for _, p := range fn.params {
+		switch {
+		case p.named:
+			if _, given := newFrame.objects[p.name]; !given {
+				return nil, fmt.Errorf("%s: missing -%s. Line: %d", cmd, p.name, k.currLine)
+			}
+		case p.rest:
+			rest := make([]*obj, 0, len(args)-i)
+			for ; i < len(args); i++ {
+				rest = append(rest, args[i].clone())
+			}
+			newFrame.objects[p.name] = newList(rest)
+		case i < len(args):
+			newFrame.objects[p.name] = args[i].clone()
+			i++
+		case p.def != nil:
+			newFrame.objects[p.name] = p.def.clone()
+		default:
+			return nil, fmt.Errorf("%s: no value given for parameter %s. Line: %d", cmd, p.name, k.currLine)
+		}
+	}
+
+	if i < len(args) {
+		return nil, fmt.Errorf("%s: too many arguments. Line: %d", cmd, k.currLine)
 	}
 
-	for ; i < len(fn.args); i++ {
-		a, err := k.parse(&codeBlock{code: fn.args[i].toString(), lineNum: k.currLine}, false)
-		if err != nil || len(a) == 0 {
-			return nil, fmt.Errorf("%s has a malformed argument. Line: %d", cmd, k.currLine)
+	for _, p := range fn.params {
+		if p.typ == "" {
+			continue
 		}
-		newFrame.objects[a[0].toString()] = a[1]
+		o := newFrame.objects[p.name]
+		if p.rest {
+			for j := range o.valList {
+				v, err := k.convertTo(o.valList[j], p.typ)
+				if err != nil {
+					return nil, fmt.Errorf("%s: argument %s %v. Line: %d", cmd, p.name, err, k.currLine)
+				}
+				o.valList[j] = v
+			}
+			continue
+		}
+		v, err := k.convertTo(o, p.typ)
+		if err != nil {
+			return nil, fmt.Errorf("%s: argument %s %v. Line: %d", cmd, p.name, err, k.currLine)
+		}
+		newFrame.objects[p.name] = v
+	}
+	return newFrame, nil
+}
+
+func call(k *Kittla, fn *command, cmd string, args []*obj) (*obj, error) {
+
+	newFrame, err := bindParams(k, fn, cmd, args)
+	if err != nil {
+		return nil, err
 	}
 
+	k.frames = append(k.frames, k.currFrame)
 	k.currFrame = newFrame
 
 	res, _, err := k.executeCore(&codeBlock{code: fn.body.toString(), lineNum: k.currLine}, false)
@@ -195,6 +650,14 @@ func call(k *Kittla, fn *command, cmd string, args []*obj) (*obj, error) {
 	k.currFrame = k.frames[len(k.frames)-1]
 	k.frames = k.frames[:len(k.frames)-1]
 
+	if err == nil && fn.result != "" {
+		if res == nil {
+			res = &obj{valType: valTypeStr}
+		}
+		if res, err = k.convertTo(res, fn.result); err != nil {
+			return nil, fmt.Errorf("%s: result %v. Line: %d", cmd, err, k.currLine)
+		}
+	}
 	return res, err
 }
 
@@ -217,7 +680,7 @@ func callFn(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
 		return nil, fmt.Errorf("Too few arguments. Got %d wants %d. Line: %d", len(args), fn.minArgs, k.currLine)
 	}
 
-	if len(args) > fn.maxArgs {
+	if fn.maxArgs != -1 && len(args) > fn.maxArgs {
 		return nil, fmt.Errorf("Too many arguments. Got %d wants %d. Line: %d", len(args), fn.maxArgs, k.currLine)
 	}
 
@@ -225,6 +688,59 @@ func callFn(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
 
 }
 
+// alias name target ?args...?
+// target can be a command prefix, like {volume inc 5}
+// Whether target is name, or an alias leading to it.
+func (k *Kittla) aliasLoop(name, target string) bool {
+	for seen := map[string]bool{}; !seen[target]; {
+		if target == name {
+			return true
+		}
+		seen[target] = true
+		c, present := k.commands[target]
+		if !present || len(c) != 1 || c[0].alias == "" {
+			return false
+		}
+		target = c[0].alias
+	}
+	return false
+}
+
+func cmdAlias(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	name := k.qualifyCmd(args[0].toString())
+
+	target, err := args[1].toList()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	if len(target) == 0 {
+		return nil, fmt.Errorf("%s: empty target. Line: %d", cmd, k.currLine)
+	}
+	_, targetName, _ := k.resolveCmd(target[0].toString())
+	if k.aliasLoop(name, targetName) {
+		return nil, fmt.Errorf("%s: %s can't be an alias of itself. Line: %d", cmd, name, k.currLine)
+	}
+
+	prefix := make([]*obj, 0, len(target)+len(args)-2)
+	for _, o := range append(target, args[2:]...) {
+		prefix = append(prefix, o.clone())
+	}
+
+	k.commands[name] = []*command{{
+		names:   []string{name},
+		minArgs: -1,
+		maxArgs: -1,
+		id:      k.nextFnId,
+		fn: func(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+			return k.callValue(newList(prefix), args...)
+		},
+		alias: targetName,
+	}}
+	k.nextFnId++
+
+	return &obj{valType: valTypeStr, valStr: []byte(name)}, nil
+}
+
 func cmdBreakContinue(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
 	switch cmdID {
 	case CMD_BREAK:
@@ -327,14 +843,14 @@ func cmdFloat(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
 func cmdFn(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
 
 	var fnName string
+	var result string
 	argIdx := 1
-	bodyIdx := 2
+	bodyIdx := len(args) - 1
 
-	if len(args) == 3 {
-		fnName = args[0].toString()
-	} else { // == 2
+	if len(args) == 3 || len(args) == 5 {
+		fnName = k.qualifyCmd(args[0].toString())
+	} else { // == 2 || == 4
 		argIdx--
-		bodyIdx--
 	}
 
 	errFnName := func() string {
@@ -350,24 +866,76 @@ func cmdFn(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
 		return nil, fmt.Errorf("Parsing arguments of %s failed with: %s. Line: %d", errFnName(), err, k.currLine)
 	}
 
+	if bodyIdx-argIdx == 3 {
+		result = args[argIdx+2].toString()
+		if args[argIdx+1].toString() != "->" || !typeNames[result] {
+			return nil, fmt.Errorf("%s: result type must be given as -> type. Line: %d", errFnName(), k.currLine)
+		}
+	}
+
+	params := make([]*param, 0, len(fnArgs))
 	minArgs := 0
+	maxArgs := 0
+	hasNamed := false
 	for i := range fnArgs {
 		arg, err := k.parse(&codeBlock{code: fnArgs[i].toString(), lineNum: k.currLine}, false)
 		if err != nil {
 			return nil, fmt.Errorf("Parsing argument \"%s\" of %s failed with: %s. Line: %d", fnArgs[i].toString(), errFnName(), err, k.currLine)
 
 		}
+		if len(arg) == 0 || len(arg) > 3 || (len(arg) == 3 && !typeNames[arg[1].toString()]) {
+			return nil, fmt.Errorf("Malformed argument \"%s\" of %s. Line: %d", fnArgs[i].toString(), errFnName(), k.currLine)
+		}
 
-		if len(arg) == 1 {
-			minArgs++
+		// {name}, {name default}, {name type} or {name type default}
+		p := &param{name: arg[0].toString()}
+		if len(arg) > 1 && typeNames[arg[1].toString()] {
+			p.typ = arg[1].toString()
+			arg = append(arg[:1], arg[2:]...)
 		}
+		if len(arg) == 2 {
+			if p.def, err = k.convertTo(arg[1], p.typ); err != nil {
+				return nil, fmt.Errorf("Default of argument %s of %s %v. Line: %d", p.name, errFnName(), err, k.currLine)
+			}
+		}
+
+		switch {
+		case strings.HasPrefix(p.name, "-"):
+			p.name = p.name[1:]
+			p.named = true
+			hasNamed = true
+			// Without a default, an untyped option is empty while a typed one must be given
+			if p.def == nil && p.typ == "" {
+				p.def = &obj{valType: valTypeStr}
+			}
+			if maxArgs != -1 {
+				maxArgs += 2
+			}
+		case p.name == "args" && p.def == nil && i == len(fnArgs)-1:
+			p.rest = true
+			maxArgs = -1
+		default:
+			if p.def == nil {
+				minArgs++
+			}
+			if maxArgs != -1 {
+				maxArgs++
+			}
+		}
+		params = append(params, p)
+	}
+	// Room for the -- ending the options
+	if hasNamed && maxArgs != -1 {
+		maxArgs++
 	}
 
-	cmdObj := &command{names: []string{fnName}, minArgs: minArgs, maxArgs: len(fnArgs), id: k.nextFnId, fn: callFn,
-		args: fnArgs, body: args[bodyIdx]}
+	cmdObj := &command{names: []string{fnName}, minArgs: minArgs, maxArgs: maxArgs, id: k.nextFnId, fn: callFn,
+		params: params, result: result, body: args[bodyIdx], ns: k.currNs()}
 	k.nextFnId++
 
-	if fnName != "" {
+	if fnName == "" {
+		cmdObj.closure = k.currFrame
+	} else {
 		replaced := false
 		for i := range k.commands[fnName] {
 			if k.commands[fnName][i].minArgs == cmdObj.minArgs &&
@@ -385,6 +953,19 @@ func cmdFn(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
 	return &obj{valType: valTypeFn, valFn: cmdObj}, nil
 }
 
+func cmdGlobal(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	if k.currFrame.root() == k.global {
+		return nil, nil
+	}
+	for i := range args {
+		name := args[i].toString()
+		if err := k.currFrame.linkVar(name, k.global, name); err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+	}
+	return nil, nil
+}
+
 func cmdIf(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
 
 	ifarg, err := k.parse(&codeBlock{code: args[0].toString(), lineNum: k.currLine}, false)
@@ -410,7 +991,7 @@ func cmdIf(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
 
 func cmdIncDec(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
 
-	o, present := k.currFrame.objects[args[0].toString()]
+	o, present := k.getVar(args[0].toString())
 
 	if !present {
 		return nil, fmt.Errorf("%s: No such variable: %s. Line %d", cmd, args[0].toString(), k.currLine)
@@ -497,51 +1078,189 @@ func cmdInt(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
 	return nil, fmt.Errorf("Can't convert string to integer. Line %d", k.currLine)
 }
 
+func cmdLocal(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	o := &obj{valType: valTypeStr}
+	if len(args) == 2 {
+		o = args[1].optimize()
+	}
+	k.currFrame.setLocal(args[0].toString(), o)
+	return o, nil
+}
+
 func cmdLoop(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
 	return cmdWhile(k, cmdID, cmd, args)
 }
 
+// puts ?-nonewline? ?chan? text
 func cmdPrint(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
-	msg := args[0].toBytes()
-	fmt.Println(string(msg))
+	newline := true
+	if len(args) > 1 && args[0].toString() == "-nonewline" {
+		newline = false
+		args = args[1:]
+	}
+
+	c := k.channels["stdout"]
+	if len(args) == 2 {
+		var err error
+		if c, err = k.channel(args[0]); err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+		args = args[1:]
+	} else if len(args) > 2 {
+		return nil, fmt.Errorf("%s: wrong number of arguments. Line: %d", cmd, k.currLine)
+	}
+
+	var msg []byte
+	if len(args) == 1 {
+		msg = args[0].toBytes()
+	}
+	out := msg
+	if newline {
+		out = append(msg[:len(msg):len(msg)], '\n')
+	}
+	if c == nil {
+		return nil, fmt.Errorf("%s: stdout is closed. Line: %d", cmd, k.currLine)
+	}
+	if err := c.write(out); err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
 	return &obj{valType: valTypeStr, valStr: msg}, nil
 }
 
+// rename old new
+// An empty new name deletes the command.
+func cmdRename(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	c, oldName, present := k.resolveCmd(args[0].toString())
+	if !present {
+		return nil, fmt.Errorf("%s: no such command: %s. Line: %d", cmd, oldName, k.currLine)
+	}
+
+	newName := args[1].toString()
+	if newName != "" {
+		newName = k.qualifyCmd(newName)
+	}
+	if _, present := k.commands[newName]; present {
+		return nil, fmt.Errorf("%s: command %s already exists. Line: %d", cmd, newName, k.currLine)
+	}
+	if newName != "" && len(c) == 1 && c[0].alias != "" && k.aliasLoop(newName, c[0].alias) {
+		return nil, fmt.Errorf("%s: %s can't be an alias of itself. Line: %d", cmd, newName, k.currLine)
+	}
+
+	delete(k.commands, oldName)
+	if newName != "" {
+		k.commands[newName] = c
+	} else {
+		k.killCoroutineOf(c)
+	}
+	return nil, nil
+}
+
 func cmdReturn(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
 
 	if len(args) == 0 {
 		return &obj{}, nil
 	}
-	if res, err := k.parse(&codeBlock{code: args[0].toString(), lineNum: k.currLine}, false); err == nil {
-		k.isReturn = true
-		if len(res) == 1 {
-			return res[0], nil
-		} else {
-			return nil, fmt.Errorf("Too many objects to return. Line: %d", k.currLine)
-		}
-	} else {
-		return nil, fmt.Errorf("Failed return given object: %v", err)
-	}
+	k.isReturn = true
+	return args[0].optimize(), nil
 }
 
 func cmdUnknown(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
 	return nil, fmt.Errorf("Unknown command: %s. Line: %d", cmd, k.currLine)
 }
 
+// Tells if the argument looks like a level, "1" or "#0"
+func isLevel(o *obj) bool {
+	s := o.toString()
+	if strings.HasPrefix(s, "#") {
+		s = s[1:]
+	}
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// unset ?-nocomplain? var ...
+func cmdUnset(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	complain := true
+	if args[0].toString() == "-nocomplain" {
+		complain = false
+		args = args[1:]
+	}
+
+	for i := range args {
+		if !k.unsetVar(args[i].toString()) && complain {
+			return nil, fmt.Errorf("%s: no such variable: %s. Line: %d", cmd, args[i].toString(), k.currLine)
+		}
+	}
+	return nil, nil
+}
+
+func cmdUplevel(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	level := "1"
+	if len(args) > 1 && isLevel(args[0]) {
+		level = args[0].toString()
+		args = args[1:]
+	}
+
+	f, frames, err := k.levelFrame(level)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+
+	script := make([]string, len(args))
+	for i := range args {
+		script[i] = args[i].toString()
+	}
+
+	savedFrames, savedFrame := k.frames, k.currFrame
+	k.frames, k.currFrame = frames, f
+
+	res, _, err := k.executeCore(&codeBlock{code: strings.Join(script, " "), lineNum: k.currLine}, true)
+
+	k.frames, k.currFrame = savedFrames, savedFrame
+	return res, err
+}
+
+func cmdUpvar(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	level := "1"
+	if len(args)%2 == 1 {
+		level = args[0].toString()
+		args = args[1:]
+	}
+
+	f, _, err := k.levelFrame(level)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		other, otherName := f, args[i].toString()
+		if strings.HasPrefix(otherName, "::") {
+			other, otherName = k.global, otherName[2:]
+		}
+		if err := k.currFrame.linkVar(args[i+1].toString(), other, otherName); err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+	}
+	return nil, nil
+}
+
 func cmdVar(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
 	varName := args[0].toString()
 	switch len(args) {
 	case 0:
 		return nil, fmt.Errorf("%s command must be followed with one or two arguments. Line: %d", cmd, k.currLine)
 	case 1:
-		if v, present := k.currFrame.objects[varName]; present {
+		if v, present := k.getVar(varName); present {
 			return v, nil
 		} else {
 			return nil, fmt.Errorf("%s: no such variable: %s. Line: %d", cmd, varName, k.currLine)
 		}
 	case 2:
-		k.currFrame.objects[varName] = args[1].optimize()
-		return k.currFrame.objects[varName], nil
+		o := args[1].optimize()
+		if err := k.setVar(varName, o); err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+		return o, nil
 	default:
 		return nil, fmt.Errorf("%s command must be followed with at most two argument. Line: %d", cmd, k.currLine)
 	}
@@ -0,0 +1,308 @@
+package kittla
+
+import (
+	"fmt"
+)
+
+// A coroutine is a command call that can suspend itself with yield and be resumed later. As the
+// interpreter keeps its call stack on the Go stack, a coroutine runs on a goroutine of its own.
+// Only one of the coroutine and its resumer runs at a time, handing over on channels.
+type coroutine struct {
+	name    string
+	k       *Kittla
+	in      chan *obj     // Resumes the coroutine, the value is the result of yield
+	out     chan coResult // Values from yield, and the result when done
+	started bool
+	running bool
+	done    bool
+	kill    bool     // Makes yield fail, to end the coroutine
+	cmd     *command // The command resuming it, nil for a generator
+
+	// State of the suspended coroutine. frames are the frames from the one the coroutine was
+	// called from, which is the resumer's, and up. Empty if the command has no frame of its own.
+	frames []*frame
+	curr   *frame
+	line   int
+
+	// Resumer, restored at yield
+	base   int
+	caller *frame
+}
+
+type coResult struct {
+	val  *obj
+	err  error
+	done bool
+}
+
+// Creates a coroutine calling f with args, not started until resumed.
+func (k *Kittla) newCoroutine(name string, f *obj, args []*obj) *coroutine {
+	co := &coroutine{name: name, k: k, in: make(chan *obj), out: make(chan coResult)}
+	k.coroutines[co] = true
+
+	go func() {
+		<-co.in
+		if co.kill {
+			co.out <- coResult{done: true}
+			return
+		}
+		res, err := k.callValue(f, args...)
+		co.out <- coResult{val: res, err: err, done: true}
+	}()
+	return co
+}
+
+// Returns why co can't be resumed by k, if it can't.
+func (co *coroutine) check(k *Kittla) error {
+	switch {
+	case co.k != k:
+		return fmt.Errorf("coroutine %s belongs to another interpreter", co.name)
+	case co.done:
+		return fmt.Errorf("coroutine %s has finished", co.name)
+	case co.running:
+		return fmt.Errorf("coroutine %s is already running", co.name)
+	}
+	return nil
+}
+
+// Resumes co, with v as the result of its yield. Returns the next yielded value, or the result of
+// the command when it has finished. done is true then. co must pass check.
+func (k *Kittla) resume(co *coroutine, v *obj) (*obj, bool, error) {
+	co.base, co.caller = len(k.frames), k.currFrame
+	line := k.currLine
+	if co.started {
+		if len(co.frames) > 0 {
+			// The resumer takes the place of the frame the coroutine was called from
+			co.frames[0] = k.currFrame
+			k.frames = append(k.frames, co.frames...)
+			k.currFrame = co.curr
+		}
+		k.currLine = co.line
+	}
+
+	prev := k.coroutine
+	k.coroutine = co
+	co.started, co.running = true, true
+	co.in <- v
+	r := <-co.out
+	co.running = false
+	k.coroutine = prev
+	k.currLine = line
+
+	if r.done {
+		co.done = true
+		delete(k.coroutines, co)
+	}
+	return r.val, r.done, r.err
+}
+
+// Suspends the running coroutine, passing v to its resumer.
+func (k *Kittla) yield(v *obj) (*obj, error) {
+	co := k.coroutine
+	if co == nil {
+		return nil, fmt.Errorf("not in a coroutine")
+	}
+	if co.kill {
+		return nil, fmt.Errorf("coroutine %s deleted", co.name)
+	}
+
+	co.frames = append([]*frame{}, k.frames[co.base:]...)
+	co.curr = k.currFrame
+	co.line = k.currLine
+	k.frames = k.frames[:co.base]
+	k.currFrame = co.caller
+
+	co.out <- coResult{val: v}
+	v = <-co.in
+	if co.kill {
+		return nil, fmt.Errorf("coroutine %s deleted", co.name)
+	}
+	return v, nil
+}
+
+// Ends co by making its yield fail. A running coroutine ends at its next yield.
+func (k *Kittla) killCoroutine(co *coroutine) {
+	co.kill = true
+	if co.running || co.done {
+		return
+	}
+	// The coroutine unwinding mustn't see or clear a break or return of the killer
+	isBreak, isContinue, isReturn := k.isBreak, k.isContinue, k.isReturn
+	k.isBreak, k.isContinue, k.isReturn = false, false, false
+	k.resume(co, nil)
+	k.isBreak, k.isContinue, k.isReturn = isBreak, isContinue, isReturn
+}
+
+// Ends the suspended coroutines, when k is closed.
+func (k *Kittla) killCoroutines() {
+	for co := range k.coroutines {
+		k.killCoroutine(co)
+	}
+}
+
+// Ends the coroutine resumed by c, when c is deleted.
+func (k *Kittla) killCoroutineOf(c []*command) {
+	for co := range k.coroutines {
+		if len(c) == 1 && co.cmd == c[0] {
+			k.killCoroutine(co)
+		}
+	}
+}
+
+// coroutine name command ?arg ...?
+// Creates the command name and calls command with the args until it yields. Returns the yielded
+// value. Calling name resumes the command, with its optional argument as the result of yield,
+// and returns the next yielded value. When the command returns, name returns its result and is
+// removed. Deleting name with rename ends the coroutine.
+func cmdCoroutine(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	name := k.qualifyCmd(args[0].toString())
+	if _, present := k.commands[name]; present {
+		return nil, fmt.Errorf("%s: command %s already exists. Line: %d", cmd, name, k.currLine)
+	}
+
+	co := k.newCoroutine(name, args[1], args[2:])
+	resume := &command{
+		names:   []string{name},
+		minArgs: 0,
+		maxArgs: 1,
+		id:      k.nextFnId,
+	}
+	co.cmd = resume
+	resume.fn = func(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+		if err := co.check(k); err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+		v := &obj{valType: valTypeStr}
+		if len(args) == 1 {
+			v = args[0].clone()
+		}
+		res, done, err := k.resume(co, v)
+		if done {
+			if c := k.commands[name]; len(c) == 1 && c[0] == resume {
+				delete(k.commands, name)
+			}
+		}
+		return res, err
+	}
+	k.commands[name] = []*command{resume}
+	k.nextFnId++
+
+	return resume.fn(k, resume.id, name, nil)
+}
+
+// yield ?value?
+// Suspends the coroutine, making the call that resumed it return value. Returns the value the
+// coroutine is resumed with.
+func cmdYield(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	// Copied, as the value may be a variable of the coroutine, which lives on
+	v := &obj{valType: valTypeStr}
+	if len(args) == 1 {
+		v = args[0].clone()
+	}
+	res, err := k.yield(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	return res, nil
+}
+
+// generator command ?arg ...?
+// Returns a handle of a coroutine calling command with the args, for foreach. It isn't started
+// until foreach asks for the first value.
+func cmdGenerator(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	k.nextGenId++
+	co := k.newCoroutine(fmt.Sprintf("generator%d", k.nextGenId), args[0], args[1:])
+	return &obj{valType: valTypeHandle, valHandle: k.newHandle("generator", co, nil)}, nil
+}
+
+// Whether a variable visible from the current frame, or a global one, holds the handle h.
+func (k *Kittla) holdsHandle(h *handle) bool {
+	for _, f := range []*frame{k.currFrame, k.global} {
+		for ; f != nil; f = f.next() {
+			for name, o := range f.objects {
+				if o.valType == valTypeLink {
+					o, _ = f.getVar(name)
+				}
+				if o != nil && o.valType == valTypeHandle && o.valHandle == h {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// foreach var list|generator body
+// Executes body with var set to each element of list, or each value yielded by the generator.
+// A generator no variable holds is ended when foreach stops early, and its handle released
+// when it has finished.
+func cmdForeach(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	name := args[0].toString()
+
+	var next func() (*obj, bool, error)
+	var co *coroutine
+	h, _ := k.handle(args[1])
+	if h != nil {
+		co, _ = h.value.(*coroutine)
+	}
+	if co != nil {
+		defer func() {
+			if !co.done && !k.holdsHandle(h) {
+				k.killCoroutine(co)
+			}
+			if co.done {
+				k.releaseHandle(h)
+			}
+		}()
+		next = func() (*obj, bool, error) {
+			if co.done {
+				return nil, false, nil
+			}
+			if err := co.check(k); err != nil {
+				return nil, false, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+			}
+			v, done, err := k.resume(co, &obj{valType: valTypeStr})
+			return v, !done && err == nil, err
+		}
+	} else {
+		l, err := args[1].toList()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+		next = func() (*obj, bool, error) {
+			if len(l) == 0 {
+				return nil, false, nil
+			}
+			v := l[0]
+			l = l[1:]
+			return v, true, nil
+		}
+	}
+
+	var res *obj
+	for {
+		v, ok, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		if err := k.setVar(name, v); err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+
+		res, _, err = k.executeCore(&codeBlock{code: args[2].toString(), lineNum: k.currLine}, true)
+		if err != nil {
+			return nil, err
+		}
+		if k.isBreak {
+			k.isBreak = false
+			break
+		}
+		if k.isContinue {
+			k.isContinue = false
+		}
+	}
+	return res, nil
+}
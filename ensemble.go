@@ -0,0 +1,109 @@
+package kittla
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// An ensemble is a command whose first argument selects a subcommand, like `info exists`.
+// Arity of the subcommands is checked before they are called. The subcommands get the
+// command name and the subcommand name, "info exists", as name.
+type ensemble map[string]*command
+
+func (e ensemble) subNames() []string {
+	names := make([]string, 0, len(e))
+	for n := range e {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// "a, b or c"
+func (e ensemble) choices() string {
+	names := e.subNames()
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+func (e ensemble) dispatch(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s: subcommand missing, must be one of: %s. Line: %d", cmd, e.choices(), k.currLine)
+	}
+
+	sub := args[0].toString()
+	c, present := e[sub]
+	if !present {
+		return nil, fmt.Errorf("%s: unknown subcommand %s, must be one of: %s. Line: %d", cmd, sub, e.choices(), k.currLine)
+	}
+
+	args = args[1:]
+	if (c.minArgs != -1 && len(args) < c.minArgs) || (c.maxArgs != -1 && len(args) > c.maxArgs) {
+		return nil, fmt.Errorf("%s %s: wrong number of arguments. Line: %d", cmd, sub, k.currLine)
+	}
+	return c.fn(k, c.id, cmd+" "+sub, args)
+}
+
+// Creates the ensemble command name. Each subcommand calls a command prefix, like {volume inc 5}.
+func (k *Kittla) createEnsemble(name string, subs map[string]*obj) {
+	e := make(ensemble, len(subs))
+	for sub, target := range subs {
+		target := target
+		e[sub] = &command{
+			names:   []string{sub},
+			minArgs: -1,
+			maxArgs: -1,
+			id:      k.nextFnId,
+			fn: func(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+				return k.callValue(target, args...)
+			},
+		}
+		k.nextFnId++
+	}
+
+	name = k.qualifyCmd(name)
+	k.commands[name] = []*command{{
+		names:    []string{name},
+		minArgs:  -1,
+		maxArgs:  -1,
+		id:       k.nextFnId,
+		fn:       e.dispatch,
+		ensemble: e,
+	}}
+	k.nextFnId++
+}
+
+// Ensemble creates a command, name, that dispatches on its first argument. Each subcommand maps
+// to a command prefix, like "volume inc 5", that is called with the remaining arguments.
+func (k *Kittla) Ensemble(name string, subs map[string]string) {
+	targets := make(map[string]*obj, len(subs))
+	for sub, target := range subs {
+		targets[sub] = &obj{valType: valTypeStr, valStr: []byte(target)}
+	}
+	k.createEnsemble(name, targets)
+}
+
+var ensembleEnsemble = ensemble{
+	"create": {minArgs: 2, maxArgs: 2, fn: ensembleCreate},
+}
+
+// ensemble create name {sub command ...}
+func ensembleCreate(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	l, err := args[1].toList()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	if len(l) == 0 || len(l)%2 != 0 {
+		return nil, fmt.Errorf("%s: subcommands must be given as pairs of name and command. Line: %d", cmd, k.currLine)
+	}
+
+	subs := make(map[string]*obj, len(l)/2)
+	for i := 0; i < len(l); i += 2 {
+		subs[l[i].toString()] = l[i+1]
+	}
+	k.createEnsemble(args[0].toString(), subs)
+	return args[0], nil
+}
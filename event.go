@@ -0,0 +1,144 @@
+package kittla
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Scripts attach handlers to events with on, and the host runs them with Emit. This lets users add
+// behavior to the application without the host knowing the names of their commands.
+
+type eventHandler struct {
+	id string
+	fn *obj // Anonymous command created by on
+}
+
+// EventError holds the errors of the handlers run by Emit, in the order they were run.
+type EventError struct {
+	Event string
+	Errs  []error
+}
+
+func (e *EventError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return e.Event + ": " + strings.Join(msgs, "; ")
+}
+
+// WithEvents limits the events handlers can be attached to with on, and emitted with Emit. Without
+// this option, any event name is accepted.
+func WithEvents(names ...string) Option {
+	return func(k *Kittla) {
+		k.events = make(map[string]bool, len(names))
+		for _, n := range names {
+			k.events[n] = true
+		}
+	}
+}
+
+// Returns an error if event isn't one of the events given with WithEvents.
+func (k *Kittla) checkEvent(event string) error {
+	if k.events == nil || k.events[event] {
+		return nil
+	}
+	names := make([]string, 0, len(k.events))
+	for n := range k.events {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown event %s, must be one of: %s", event, strings.Join(names, ", "))
+}
+
+// Emit runs the handlers of event at the global level, in the order they were added, with args
+// converted like the results of functions given to Bind. All handlers are run even if some fail,
+// the errors are returned as an *EventError.
+func (k *Kittla) Emit(event string, args ...any) error {
+	if err := k.checkEvent(event); err != nil {
+		return err
+	}
+
+	handlers := append([]*eventHandler{}, k.handlers[event]...)
+	if len(handlers) == 0 {
+		return nil
+	}
+	objs := make([]*obj, len(args))
+	for i, a := range args {
+		if objs[i] = k.fromAny(a); objs[i] == nil {
+			objs[i] = &obj{valType: valTypeStr}
+		}
+	}
+
+	var errs []error
+	for _, h := range handlers {
+		if _, err := k.callGlobal(h.fn, objs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if errs != nil {
+		return &EventError{Event: event, Errs: errs}
+	}
+	return nil
+}
+
+// Calls the command f with args at the global level.
+func (k *Kittla) callGlobal(f *obj, args []*obj) (*obj, error) {
+	k.frames = append(k.frames, k.currFrame)
+	k.currFrame = k.global
+
+	callArgs := make([]*obj, len(args))
+	for i := range args {
+		callArgs[i] = args[i].clone()
+	}
+	res, err := k.callValue(f, callArgs...)
+
+	k.currFrame = k.frames[len(k.frames)-1]
+	k.frames = k.frames[:len(k.frames)-1]
+	k.isBreak, k.isContinue, k.isReturn = false, false, false
+	return res, err
+}
+
+// on eventName {args} {body}
+// Adds a handler to the event. Returns its id, for off.
+func cmdOn(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	event := args[0].toString()
+	if err := k.checkEvent(event); err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+
+	fn, err := cmdFn(k, CMD_FN, "fn", args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	k.nextHandlerId++
+	h := &eventHandler{id: fmt.Sprintf("%s%d", event, k.nextHandlerId), fn: fn}
+	k.handlers[event] = append(k.handlers[event], h)
+	return &obj{valType: valTypeStr, valStr: []byte(h.id)}, nil
+}
+
+// off eventName ?id?
+// Removes the handler with the id returned by on, or all handlers of the event.
+func cmdOff(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	event := args[0].toString()
+	if err := k.checkEvent(event); err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+
+	if len(args) == 1 {
+		delete(k.handlers, event)
+		return nil, nil
+	}
+
+	id := args[1].toString()
+	handlers := k.handlers[event]
+	for i, h := range handlers {
+		if h.id == id {
+			k.handlers[event] = append(handlers[:i:i], handlers[i+1:]...)
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: no handler %s for event %s. Line: %d", cmd, id, event, k.currLine)
+}
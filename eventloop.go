@@ -0,0 +1,237 @@
+package kittla
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The event loop runs scripts scheduled with after. The host drives it with RunPending and
+// NextDeadline, or blocks in RunEvents until nothing is scheduled. vwait and update run it from
+// scripts.
+
+// The clock of the event loop, replaced by tests.
+type clock interface {
+	Now() time.Time
+	// Sleep waits for d, or returns the error of ctx if it is done first.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	wait := time.NewTimer(d)
+	defer wait.Stop()
+	select {
+	case <-wait.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type timer struct {
+	id     string
+	at     time.Time
+	idle   bool // Run when the loop is idle, at is ignored
+	script string
+}
+
+// Schedules script, after d or when idle.
+func (k *Kittla) schedule(d time.Duration, idle bool, script string) *timer {
+	k.nextTimerId++
+	t := &timer{id: "after#" + strconv.Itoa(k.nextTimerId), at: k.clock.Now().Add(d), idle: idle, script: script}
+	k.timers = append(k.timers, t)
+	return t
+}
+
+// Removes t, returns false if it was already run or cancelled.
+func (k *Kittla) unschedule(t *timer) bool {
+	for i := range k.timers {
+		if k.timers[i] == t {
+			k.timers = append(k.timers[:i], k.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// RunPending runs the scripts scheduled with after that are due, in the order of their deadlines,
+// and then the ones scheduled with after idle. Errors are reported with bgerror. Returns the
+// number of scripts run.
+func (k *Kittla) RunPending() int {
+	now := k.clock.Now()
+	due := make([]*timer, 0, len(k.timers))
+	idle := make([]*timer, 0, len(k.timers))
+	for _, t := range k.timers {
+		if t.idle {
+			idle = append(idle, t)
+		} else if !t.at.After(now) {
+			due = append(due, t)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+
+	n := 0
+	for _, t := range append(due, idle...) {
+		// An earlier script may have cancelled it
+		if !k.unschedule(t) {
+			continue
+		}
+		if _, err := k.evalGlobal(t.script); err != nil {
+			k.bgerror(err)
+		}
+		n++
+	}
+	return n
+}
+
+// NextDeadline returns when RunPending has something to run, false if nothing is scheduled.
+func (k *Kittla) NextDeadline() (time.Time, bool) {
+	var next time.Time
+	for _, t := range k.timers {
+		at := t.at
+		if t.idle {
+			at = k.clock.Now()
+		}
+		if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Waits until d or the context of k is done.
+func (k *Kittla) sleepUntil(d time.Time) error {
+	return k.clock.Sleep(k.ctx, d.Sub(k.clock.Now()))
+}
+
+// RunEvents runs the scheduled scripts, waiting for their deadlines, until nothing is scheduled
+// or the context of k is done.
+func (k *Kittla) RunEvents() error {
+	for {
+		next, ok := k.NextDeadline()
+		if !ok {
+			return nil
+		}
+		if err := k.sleepUntil(next); err != nil {
+			return err
+		}
+		k.RunPending()
+	}
+}
+
+// Reports an error from a scheduled script to the bgerror command, or to stderr if there is none
+// or it fails too.
+func (k *Kittla) bgerror(err error) {
+	if _, _, present := k.resolveCmd("bgerror"); present {
+		msg := &obj{valType: valTypeStr, valStr: []byte(err.Error())}
+		_, herr := k.callGlobal(&obj{valType: valTypeStr, valStr: []byte("bgerror")}, []*obj{msg})
+		if herr == nil {
+			return
+		}
+		err = fmt.Errorf("%v, bgerror failed with: %v", err, herr)
+	}
+	if c, present := k.channels["stderr"]; present {
+		c.write([]byte("background error: " + err.Error() + "\n"))
+	}
+}
+
+// Joins args like concat, for scripts given as several arguments.
+func joinArgs(args []*obj) string {
+	parts := make([][]byte, len(args))
+	for i := range args {
+		parts[i] = args[i].toBytes()
+	}
+	return string(bytes.Join(parts, []byte(" ")))
+}
+
+// after ms ?script ...?
+// after idle script ?script ...?
+// after cancel id|script ?script ...?
+// Without a script, after sleeps for ms milliseconds. Otherwise the script is scheduled and its
+// id returned.
+func cmdAfter(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	switch args[0].toString() {
+	case "idle":
+		if len(args) < 2 {
+			return nil, fmt.Errorf("%s: idle needs a script. Line: %d", cmd, k.currLine)
+		}
+		t := k.schedule(0, true, joinArgs(args[1:]))
+		return &obj{valType: valTypeStr, valStr: []byte(t.id)}, nil
+	case "cancel":
+		if len(args) < 2 {
+			return nil, fmt.Errorf("%s: cancel needs an id or a script. Line: %d", cmd, k.currLine)
+		}
+		what := joinArgs(args[1:])
+		for _, t := range k.timers {
+			if t.id == what || t.script == what {
+				k.unschedule(t)
+				break
+			}
+		}
+		return nil, nil
+	}
+
+	d, err := timeoutArg(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v, must be milliseconds, idle or cancel. Line: %d", cmd, err, k.currLine)
+	}
+	if len(args) == 1 {
+		if err := k.sleepUntil(k.clock.Now().Add(d)); err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+		return nil, nil
+	}
+	t := k.schedule(d, false, joinArgs(args[1:]))
+	return &obj{valType: valTypeStr, valStr: []byte(t.id)}, nil
+}
+
+// update
+// Runs the scheduled scripts that are due.
+func cmdUpdate(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	k.RunPending()
+	return nil, nil
+}
+
+// vwait var
+// Runs the event loop until var is written.
+func cmdVwait(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	name := args[0].toString()
+	f, local, err := k.varFrame(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+
+	// There are no variable traces. A write either stores a new value or, like inc, changes the
+	// value in place.
+	value := func() (*obj, string) {
+		o, present := f.getVar(local)
+		if !present {
+			return nil, ""
+		}
+		return o, o.toString()
+	}
+	before, beforeStr := value()
+
+	for {
+		if now, nowStr := value(); now != before || nowStr != beforeStr {
+			return nil, nil
+		}
+		next, ok := k.NextDeadline()
+		if !ok {
+			return nil, fmt.Errorf("%s: would wait forever for %s, nothing is scheduled. Line: %d", cmd, name, k.currLine)
+		}
+		if err := k.sleepUntil(next); err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+		k.RunPending()
+	}
+}
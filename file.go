@@ -0,0 +1,192 @@
+package kittla
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var fileEnsemble = ensemble{
+	"delete":    {minArgs: 1, maxArgs: -1, fn: fileDelete},
+	"dirname":   {minArgs: 1, maxArgs: 1, fn: fileDirname},
+	"exists":    {minArgs: 1, maxArgs: 1, fn: fileExists},
+	"extension": {minArgs: 1, maxArgs: 1, fn: fileExtension},
+	"isdir":     {minArgs: 1, maxArgs: 1, fn: fileIsDir},
+	"isfile":    {minArgs: 1, maxArgs: 1, fn: fileIsFile},
+	"join":      {minArgs: 1, maxArgs: -1, fn: fileJoin},
+	"mkdir":     {minArgs: 1, maxArgs: -1, fn: fileMkdir},
+	"mtime":     {minArgs: 1, maxArgs: 1, fn: fileMtime},
+	"normalize": {minArgs: 1, maxArgs: 1, fn: fileNormalize},
+	"rename":    {minArgs: 2, maxArgs: 3, fn: fileRename},
+	"rootname":  {minArgs: 1, maxArgs: 1, fn: fileRootname},
+	"size":      {minArgs: 1, maxArgs: 1, fn: fileSize},
+	"tail":      {minArgs: 1, maxArgs: 1, fn: fileTail},
+}
+
+// file delete ?-force? path ...
+// Missing files are ignored. Non-empty directories are only removed with -force.
+func fileDelete(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	remove := os.Remove
+	if args[0].toString() == "-force" {
+		remove = os.RemoveAll
+		args = args[1:]
+	}
+	for i := range args {
+		if err := remove(args[i].toString()); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+	}
+	return nil, nil
+}
+
+func fileDirname(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	return &obj{valType: valTypeStr, valStr: []byte(filepath.Dir(args[0].toString()))}, nil
+}
+
+func fileExists(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	_, err := os.Stat(args[0].toString())
+	return &obj{valType: valTypeBool, valBool: err == nil}, nil
+}
+
+func fileExtension(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	return &obj{valType: valTypeStr, valStr: []byte(filepath.Ext(args[0].toString()))}, nil
+}
+
+func fileIsDir(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	fi, err := os.Stat(args[0].toString())
+	return &obj{valType: valTypeBool, valBool: err == nil && fi.IsDir()}, nil
+}
+
+func fileIsFile(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	fi, err := os.Stat(args[0].toString())
+	return &obj{valType: valTypeBool, valBool: err == nil && fi.Mode().IsRegular()}, nil
+}
+
+// file join name ...
+// An absolute name discards the names before it.
+func fileJoin(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	res := ""
+	for i := range args {
+		if name := args[i].toString(); filepath.IsAbs(name) {
+			res = name
+		} else {
+			res = filepath.Join(res, name)
+		}
+	}
+	return &obj{valType: valTypeStr, valStr: []byte(res)}, nil
+}
+
+// file mkdir dir ...
+// Creates missing parent directories too.
+func fileMkdir(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	for i := range args {
+		if err := os.MkdirAll(args[i].toString(), 0777); err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+	}
+	return nil, nil
+}
+
+// Modification time in seconds since the epoch.
+func fileMtime(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	fi, err := os.Stat(args[0].toString())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	return &obj{valType: valTypeInt, valInt: int(fi.ModTime().Unix())}, nil
+}
+
+func fileNormalize(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	name, err := filepath.Abs(args[0].toString())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	return &obj{valType: valTypeStr, valStr: []byte(name)}, nil
+}
+
+// file rename ?-force? source target
+// An existing target is only overwritten with -force.
+func fileRename(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	force := false
+	if len(args) == 3 {
+		if args[0].toString() != "-force" {
+			return nil, fmt.Errorf("%s: bad option %s, must be -force. Line: %d", cmd, args[0].toString(), k.currLine)
+		}
+		force = true
+		args = args[1:]
+	}
+	target := args[1].toString()
+	if _, err := os.Stat(target); err == nil && !force {
+		return nil, fmt.Errorf("%s: %s already exists. Line: %d", cmd, target, k.currLine)
+	}
+	if err := os.Rename(args[0].toString(), target); err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	return nil, nil
+}
+
+func fileRootname(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	name := args[0].toString()
+	return &obj{valType: valTypeStr, valStr: []byte(strings.TrimSuffix(name, filepath.Ext(name)))}, nil
+}
+
+func fileSize(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	fi, err := os.Stat(args[0].toString())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	return &obj{valType: valTypeInt, valInt: int(fi.Size())}, nil
+}
+
+func fileTail(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	return &obj{valType: valTypeStr, valStr: []byte(filepath.Base(args[0].toString()))}, nil
+}
+
+// glob ?-directory dir? ?-types f|d? pattern ...
+// Returns the sorted list of matching names, empty if there are none. With -directory, the
+// patterns are relative to dir.
+func cmdGlob(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	dir := ""
+	types := ""
+
+	for len(args) > 1 && strings.HasPrefix(args[0].toString(), "-") {
+		switch args[0].toString() {
+		case "-directory":
+			dir = args[1].toString()
+		case "-types":
+			types = args[1].toString()
+			if types != "f" && types != "d" {
+				return nil, fmt.Errorf("%s: bad type %s, must be f or d. Line: %d", cmd, types, k.currLine)
+			}
+		default:
+			return nil, fmt.Errorf("%s: bad option %s, must be -directory or -types. Line: %d", cmd, args[0].toString(), k.currLine)
+		}
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s: pattern missing. Line: %d", cmd, k.currLine)
+	}
+
+	names := make([]string, 0, 16)
+	for i := range args {
+		pattern := args[i].toString()
+		if dir != "" {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+		for _, m := range matches {
+			if types != "" {
+				fi, err := os.Stat(m)
+				if err != nil || (types == "d") != fi.IsDir() {
+					continue
+				}
+			}
+			names = append(names, m)
+		}
+	}
+	return matchNames(names, ""), nil
+}
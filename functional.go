@@ -0,0 +1,199 @@
+package kittla
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Commands that take a command as argument. The command can be an anonymous command, the
+// name of a command or a command prefix like {add 5}.
+
+// Calls the command f with args.
+func (k *Kittla) callValue(f *obj, args ...*obj) (*obj, error) {
+	cmdArgs := []*obj{f}
+	if f.valType == valTypeStr || f.valType == valTypeList {
+		prefix, err := f.toList()
+		if err != nil {
+			return nil, err
+		}
+		if len(prefix) == 0 {
+			return nil, fmt.Errorf("empty command")
+		}
+		cmdArgs = append([]*obj{}, prefix...)
+	}
+
+	res, err := k.executeCmd(append(cmdArgs, args...))
+	if res == nil && err == nil {
+		res = &obj{valType: valTypeStr}
+	}
+	return res, err
+}
+
+func cmdApply(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	return k.callValue(args[0], args[1:]...)
+}
+
+func cmdCurry(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+
+	bound := make([]*obj, len(args))
+	for i := range args {
+		bound[i] = args[i].clone()
+	}
+
+	minArgs := -1
+	maxArgs := -1
+	if f := bound[0]; f.valType == valTypeFn {
+		minArgs = f.valFn.minArgs - (len(bound) - 1)
+		if minArgs < 0 {
+			minArgs = 0
+		}
+		if f.valFn.maxArgs != -1 {
+			maxArgs = f.valFn.maxArgs - (len(bound) - 1)
+			if maxArgs < 0 {
+				return nil, fmt.Errorf("%s: too many arguments for the command. Line: %d", cmd, k.currLine)
+			}
+		}
+	}
+
+	curried := &command{
+		names:   []string{string(listToBytes(bound))},
+		minArgs: minArgs,
+		maxArgs: maxArgs,
+		id:      k.nextFnId,
+		fn: func(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+			return k.callValue(bound[0], append(bound[1:len(bound):len(bound)], args...)...)
+		},
+	}
+	k.nextFnId++
+
+	return &obj{valType: valTypeFn, valFn: curried}, nil
+}
+
+func cmdFilter(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	l, err := args[1].toList()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+
+	res := make([]*obj, 0, len(l))
+	for i := range l {
+		keep, err := k.callValue(args[0], l[i])
+		if err != nil {
+			return nil, err
+		}
+		if keep.isTrue() {
+			res = append(res, l[i])
+		}
+	}
+	return newList(res), nil
+}
+
+func cmdMap(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	l, err := args[1].toList()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+
+	res := make([]*obj, len(l))
+	for i := range l {
+		if res[i], err = k.callValue(args[0], l[i]); err != nil {
+			return nil, err
+		}
+	}
+	return newList(res), nil
+}
+
+func cmdReduce(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	l, err := args[2].toList()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+
+	acc := args[1]
+	for i := range l {
+		if acc, err = k.callValue(args[0], acc, l[i]); err != nil {
+			return nil, err
+		}
+	}
+	return acc, nil
+}
+
+func isNumber(o *obj) bool {
+	return o.valType == valTypeInt || o.valType == valTypeFloat
+}
+
+func (o *obj) toFloat() float64 {
+	if o.valType == valTypeInt {
+		return float64(o.valInt)
+	}
+	return o.valFloat
+}
+
+// sort ?-by command? ?-decreasing? list
+// The -by command is called with two elements and returns a negative number, zero or a positive
+// number when the first one is less than, equal to or greater than the second one.
+func cmdSort(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+
+	var by *obj
+	decreasing := false
+
+	for len(args) > 1 {
+		switch args[0].toString() {
+		case "-by":
+			by = args[1]
+			args = args[2:]
+		case "-decreasing":
+			decreasing = true
+			args = args[1:]
+		default:
+			return nil, fmt.Errorf("%s: bad option %s, must be -by or -decreasing. Line: %d", cmd, args[0].toString(), k.currLine)
+		}
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s: list missing. Line: %d", cmd, k.currLine)
+	}
+
+	l, err := args[0].toList()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	res := append([]*obj{}, l...)
+
+	compare := func(a, b *obj) int {
+		if by != nil {
+			if err != nil {
+				return 0
+			}
+			var r *obj
+			if r, err = k.callValue(by, a, b); err == nil && r.valType != valTypeInt {
+				err = fmt.Errorf("%s: -by command must return an integer, got \"%s\". Line: %d", cmd, r.toString(), k.currLine)
+			}
+			if err != nil {
+				return 0
+			}
+			return r.valInt
+		}
+		if isNumber(a) && isNumber(b) {
+			switch {
+			case a.toFloat() < b.toFloat():
+				return -1
+			case a.toFloat() > b.toFloat():
+				return 1
+			}
+			return 0
+		}
+		return bytes.Compare(a.toBytes(), b.toBytes())
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		if decreasing {
+			return compare(res[i], res[j]) > 0
+		}
+		return compare(res[i], res[j]) < 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newList(res), nil
+}
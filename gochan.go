@@ -0,0 +1,199 @@
+package kittla
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Go channels are given to scripts as handles. Values sent and received are converted like the
+// arguments and results of bound functions.
+
+// ExposeChan gives the Go channel ch to scripts, in the global variable name.
+func (k *Kittla) ExposeChan(name string, ch any) error {
+	if reflect.ValueOf(ch).Kind() != reflect.Chan {
+		return fmt.Errorf("%s: %T isn't a channel", name, ch)
+	}
+	k.global.setVar(name, &obj{valType: valTypeHandle, valHandle: k.newHandle("chan", ch, nil)})
+	return nil
+}
+
+// Returns the Go channel o refers to, a handle or a variable holding one.
+func (k *Kittla) goChan(o *obj) (reflect.Value, error) {
+	h, present := k.handle(o)
+	if !present {
+		if v, exists := k.getVar(o.toString()); exists {
+			h, present = k.handle(v)
+		}
+	}
+	if !present || reflect.ValueOf(h.value).Kind() != reflect.Chan {
+		return reflect.Value{}, fmt.Errorf("\"%s\" isn't a channel", o.toString())
+	}
+	return reflect.ValueOf(h.value), nil
+}
+
+// A timeout in milliseconds.
+func timeoutArg(o *obj) (time.Duration, error) {
+	ms, err := strconv.Atoi(o.toString())
+	if err != nil || ms < 0 {
+		return 0, fmt.Errorf("bad timeout %s", o.toString())
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+var chanEnsemble = ensemble{
+	"close":  {minArgs: 1, maxArgs: 1, fn: chanClose},
+	"create": {minArgs: 0, maxArgs: 1, fn: chanCreate},
+	"recv":   {minArgs: 1, maxArgs: 2, fn: chanRecv},
+	"send":   {minArgs: 2, maxArgs: 2, fn: chanSend},
+}
+
+func chanClose(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	c, err := k.goChan(args[0])
+	if err == nil {
+		err = closeChan(c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	return nil, nil
+}
+
+// Closing a closed channel panics.
+func closeChan(c reflect.Value) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	c.Close()
+	return nil
+}
+
+// chan recv c ?timeout?
+// Waits for a value, at most timeout milliseconds. Returns an empty string on timeout and
+// when the channel is closed, and fails when the context of k is cancelled.
+func chanRecv(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	c, err := k.goChan(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: c},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(k.ctx.Done())},
+	}
+	if len(args) == 2 {
+		timeout, err := timeoutArg(args[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(time.After(timeout))})
+	}
+
+	chosen, v, ok := reflect.Select(cases)
+	if chosen == 1 {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, k.ctx.Err(), k.currLine)
+	}
+	if chosen != 0 || !ok {
+		return &obj{valType: valTypeStr}, nil
+	}
+	return k.fromGo(v), nil
+}
+
+// Sends v on c unless ctx is cancelled first. Sending on a closed channel panics.
+func sendChan(ctx context.Context, c, v reflect.Value) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	chosen, _, _ := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: c, Send: v},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+	})
+	if chosen == 1 {
+		return ctx.Err()
+	}
+	return nil
+}
+
+func chanSend(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	c, err := k.goChan(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	v, err := k.toGo(args[1], c.Type().Elem())
+	if err == nil {
+		err = sendChan(k.ctx, c, v)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	return args[1], nil
+}
+
+// select {chan var body ... ?timeout ms body?}
+// Waits for a value from one of the channels, stores it in var and executes body. var is - to
+// not store the value. With a timeout of 0, the timeout body is executed if no channel has a
+// value right away. Fails when the context of k is cancelled.
+func cmdSelect(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	l, err := args[0].toList()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	if len(l) == 0 || len(l)%3 != 0 {
+		return nil, fmt.Errorf("%s: cases must be given as channel var body or timeout ms body. Line: %d", cmd, k.currLine)
+	}
+
+	cases := make([]reflect.SelectCase, 0, len(l)/3+1)
+	vars := make([]string, 0, len(l)/3)
+	bodies := make([]string, 0, len(l)/3)
+
+	for i := 0; i < len(l); i += 3 {
+		if l[i].toString() == "timeout" {
+			timeout, err := timeoutArg(l[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+			}
+			if timeout == 0 {
+				cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+			} else {
+				cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(time.After(timeout))})
+			}
+			vars = append(vars, "")
+		} else {
+			c, err := k.goChan(l[i])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+			}
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: c})
+			if name := l[i+1].toString(); name != "-" {
+				vars = append(vars, name)
+			} else {
+				vars = append(vars, "")
+			}
+		}
+		bodies = append(bodies, l[i+2].toString())
+	}
+
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(k.ctx.Done())})
+	chosen, v, ok := reflect.Select(cases)
+	if chosen == len(cases)-1 {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, k.ctx.Err(), k.currLine)
+	}
+	if vars[chosen] != "" {
+		value := &obj{valType: valTypeStr}
+		if ok {
+			value = k.fromGo(v)
+		}
+		if err := k.setVar(vars[chosen], value); err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+	}
+
+	res, _, err := k.executeCore(&codeBlock{code: bodies[chosen], lineNum: k.currLine}, true)
+	return res, err
+}
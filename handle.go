@@ -0,0 +1,136 @@
+package kittla
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A handle is a Go value given to scripts as it is, like an open connection. Scripts see its
+// name, like handle:conn1, and the value is found again from the name when passed back to Go.
+type handle struct {
+	name    string
+	typ     string
+	id      int
+	value   any
+	release func(any) // Called when the handle is released, may be nil
+}
+
+// NewHandle gives v to scripts as a handle of the type typ. Returns the name of the handle, like
+// handle:conn1. release, if not nil, is called with v when the handle is released or the
+// interpreter closed.
+func (k *Kittla) NewHandle(typ string, v any, release func(any)) string {
+	return k.newHandle(typ, v, release).name
+}
+
+func (k *Kittla) newHandle(typ string, v any, release func(any)) *handle {
+	k.nextHandleId++
+	h := &handle{typ: typ, id: k.nextHandleId, value: v, release: release}
+	h.name = "handle:" + typ + strconv.Itoa(h.id)
+	k.handles[h.name] = h
+	if isComparable(v) {
+		k.handleOf[v] = h
+	}
+	return h
+}
+
+// Whether v can be a map key. A struct of a comparable type still panics when compared if a field
+// of interface type holds an uncomparable value.
+func isComparable(v any) (ok bool) {
+	if v == nil || !reflect.TypeOf(v).Comparable() {
+		return false
+	}
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	return v == v
+}
+
+// A handle for a Go value without a kittla counterpart. The same value gets the same handle.
+func (k *Kittla) handleFor(v reflect.Value) *obj {
+	if isComparable(v.Interface()) {
+		if h, present := k.handleOf[v.Interface()]; present {
+			return &obj{valType: valTypeHandle, valHandle: h}
+		}
+	}
+	t := v.Type()
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	typ := strings.ToLower(t.Name())
+	if typ == "" {
+		typ = strings.ToLower(t.Kind().String())
+	}
+	return &obj{valType: valTypeHandle, valHandle: k.newHandle(typ, v.Interface(), nil)}
+}
+
+// Handle returns the value of the handle named name, as returned by NewHandle.
+func (k *Kittla) Handle(name string) (any, bool) {
+	if h, present := k.handles[name]; present {
+		return h.value, true
+	}
+	return nil, false
+}
+
+// ReleaseHandle forgets the handle named name, calling its release function.
+func (k *Kittla) ReleaseHandle(name string) error {
+	h, present := k.handles[name]
+	if !present {
+		return fmt.Errorf("no handle named %s", name)
+	}
+	k.releaseHandle(h)
+	return nil
+}
+
+func (k *Kittla) releaseHandle(h *handle) {
+	delete(k.handles, h.name)
+	if isComparable(h.value) && k.handleOf[h.value] == h {
+		delete(k.handleOf, h.value)
+	}
+	if h.release != nil {
+		h.release(h.value)
+	}
+}
+
+// Returns the handle o refers to, a handle value or the name of a handle.
+func (k *Kittla) handle(o *obj) (*handle, bool) {
+	if o.valType == valTypeHandle {
+		_, present := k.handles[o.valHandle.name]
+		return o.valHandle, present
+	}
+	h, present := k.handles[o.toString()]
+	return h, present
+}
+
+// Close releases the handles of k, newest first, and closes its channels and child interpreters.
+// Scheduled scripts are dropped and suspended coroutines ended. Returns the first error from
+// closing a channel.
+func (k *Kittla) Close() error {
+	k.timers = nil
+	k.killCoroutines()
+
+	for _, name := range k.ChildNames() {
+		k.DeleteChild(name)
+	}
+
+	handles := make([]*handle, 0, len(k.handles))
+	for _, h := range k.handles {
+		handles = append(handles, h)
+	}
+	sort.Slice(handles, func(i, j int) bool { return handles[i].id > handles[j].id })
+	for _, h := range handles {
+		k.releaseHandle(h)
+	}
+
+	var err error
+	for _, c := range k.channels {
+		if cerr := k.closeChannel(c); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,195 @@
+package kittla
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// Names matching a glob pattern, sorted. Empty pattern matches everything.
+func matchNames(names []string, pattern string) *obj {
+	res := make([]*obj, 0, len(names))
+	sort.Strings(names)
+	for _, n := range names {
+		if ok, _ := path.Match(pattern, n); ok || pattern == "" {
+			res = append(res, &obj{valType: valTypeStr, valStr: []byte(n)})
+		}
+	}
+	return newList(res)
+}
+
+// Returns the command defined with fn that o refers to. Either an anonymous command, a variable
+// holding one or the name of a command.
+func (k *Kittla) fnCommand(o *obj) (*command, error) {
+	if o.valType == valTypeFn && o.valFn.body != nil {
+		return o.valFn, nil
+	}
+	if v, present := k.getVar(o.toString()); present && v.valType == valTypeFn && v.valFn.body != nil {
+		return v.valFn, nil
+	}
+	cmds, _, _ := k.resolveCmd(o.toString())
+	for _, c := range cmds {
+		if c.body != nil {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("\"%s\" isn't a command defined with fn", o.toString())
+}
+
+// Names of all variables visible from the current frame.
+func (k *Kittla) visibleVars() []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0, 64)
+	for f := k.currFrame; f != nil; {
+		for n := range f.objects {
+			if !seen[n] {
+				seen[n] = true
+				names = append(names, n)
+			}
+		}
+		if f.parent != nil {
+			f = f.parent
+		} else {
+			f = f.closure
+		}
+	}
+	return names
+}
+
+// Number of the current level, 0 is the global level.
+func (k *Kittla) currLevel() int {
+	level := 0
+	for _, f := range append(k.frames[:len(k.frames):len(k.frames)], k.currFrame) {
+		if f.parent == nil && f != k.global {
+			level++
+		}
+	}
+	return level
+}
+
+var infoEnsemble = ensemble{
+	"args":     {minArgs: 1, maxArgs: 1, fn: infoArgs},
+	"body":     {minArgs: 1, maxArgs: 1, fn: infoBody},
+	"commands": {minArgs: 0, maxArgs: 1, fn: infoCommands},
+	"complete": {minArgs: 1, maxArgs: 1, fn: infoComplete},
+	"default":  {minArgs: 3, maxArgs: 3, fn: infoDefault},
+	"exists":   {minArgs: 1, maxArgs: 1, fn: infoExists},
+	"globals":  {minArgs: 0, maxArgs: 1, fn: infoGlobals},
+	"level":    {minArgs: 0, maxArgs: 1, fn: infoLevel},
+	"script":   {minArgs: 0, maxArgs: 0, fn: infoScript},
+	"type":     {minArgs: 1, maxArgs: 1, fn: infoType},
+	"vars":     {minArgs: 0, maxArgs: 1, fn: infoVars},
+}
+
+// The optional pattern argument of info commands, info globals and info vars
+func patternArg(args []*obj) string {
+	if len(args) == 1 {
+		return args[0].toString()
+	}
+	return ""
+}
+
+func infoArgs(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	fn, err := k.fnCommand(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	names := make([]*obj, len(fn.params))
+	for i, p := range fn.params {
+		name := p.name
+		if p.named {
+			name = "-" + name
+		}
+		names[i] = &obj{valType: valTypeStr, valStr: []byte(name)}
+	}
+	return newList(names), nil
+}
+
+func infoBody(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	fn, err := k.fnCommand(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	return fn.body, nil
+}
+
+func infoCommands(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	names := make([]string, 0, len(k.commands))
+	for n := range k.commands {
+		names = append(names, n)
+	}
+	return matchNames(names, patternArg(args)), nil
+}
+
+func infoComplete(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	return &obj{valType: valTypeBool, valBool: k.GetNumUnclosed(args[0].toString()) == 0}, nil
+}
+
+// info default fn arg var
+func infoDefault(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	fn, err := k.fnCommand(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	name := args[1].toString()
+	for _, p := range fn.params {
+		if p.name == name || (p.named && "-"+p.name == name) {
+			def := &obj{valType: valTypeStr}
+			if p.def != nil {
+				def = p.def.clone()
+			}
+			if err := k.setVar(args[2].toString(), def); err != nil {
+				return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+			}
+			return &obj{valType: valTypeBool, valBool: p.def != nil}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: %s has no argument %s. Line: %d", cmd, args[0].toString(), name, k.currLine)
+}
+
+func infoExists(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	_, present := k.getVar(args[0].toString())
+	return &obj{valType: valTypeBool, valBool: present}, nil
+}
+
+func infoGlobals(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	names := make([]string, 0, len(k.global.objects))
+	for n := range k.global.objects {
+		names = append(names, n)
+	}
+	return matchNames(names, patternArg(args)), nil
+}
+
+// info level ?n?
+// Without n, the current level. With n, the command and arguments of level n. n <= 0 is relative.
+func infoLevel(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	if len(args) == 0 {
+		return &obj{valType: valTypeInt, valInt: k.currLevel()}, nil
+	}
+	n, err := strconv.Atoi(args[0].toString())
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad level %s. Line: %d", cmd, args[0].toString(), k.currLine)
+	}
+	level := "#" + strconv.Itoa(n)
+	if n <= 0 {
+		level = strconv.Itoa(-n)
+	}
+	f, _, err := k.levelFrame(level)
+	if err != nil || f.root() == k.global {
+		return nil, fmt.Errorf("%s: bad level %s. Line: %d", cmd, args[0].toString(), k.currLine)
+	}
+	return newList(f.root().call), nil
+}
+
+func infoScript(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	return &obj{valType: valTypeStr, valStr: []byte(k.script)}, nil
+}
+
+func infoType(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	return &obj{valType: valTypeStr, valStr: []byte(args[0].valType.String())}, nil
+}
+
+func infoVars(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	return matchNames(k.visibleVars(), patternArg(args)), nil
+}
@@ -0,0 +1,245 @@
+package kittla
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Child interpreters have their own commands, variables and frames. Nothing is shared with the
+// parent. Values passed between interpreters are copied, and commands, channels and handles pass
+// as their names. A child never gets capabilities its parent lacks.
+
+// Copies a value into another interpreter.
+func crossValue(o *obj) *obj {
+	if o == nil {
+		return &obj{valType: valTypeStr}
+	}
+	switch o.valType {
+	case valTypeList:
+		l := make([]*obj, len(o.valList))
+		for i := range o.valList {
+			l[i] = crossValue(o.valList[i])
+		}
+		return newList(l)
+	case valTypeFn, valTypeChan, valTypeLink, valTypeHandle:
+		return &obj{valType: valTypeStr, valStr: append([]byte{}, o.toBytes()...)}
+	}
+	return o.clone()
+}
+
+// Executes script at the global level of k.
+func (k *Kittla) evalGlobal(script string) (*obj, error) {
+	if k.deleted {
+		return nil, fmt.Errorf("interpreter deleted")
+	}
+	k.frames = append(k.frames, k.currFrame)
+	k.currFrame = k.global
+
+	res, _, err := k.executeCore(&codeBlock{code: script, lineNum: 1}, true)
+
+	k.currFrame = k.frames[len(k.frames)-1]
+	k.frames = k.frames[:len(k.frames)-1]
+
+	switch {
+	case err != nil:
+	case k.isBreak, k.isContinue:
+		err = fmt.Errorf("break or continue outside of a loop")
+	}
+	k.isBreak, k.isContinue, k.isReturn = false, false, false
+	return res, err
+}
+
+// CreateChild creates a child interpreter called name. The child has the capabilities of k,
+// reduced by opts.
+func (k *Kittla) CreateChild(name string, opts ...Option) (*Kittla, error) {
+	if _, present := k.children[name]; present {
+		return nil, fmt.Errorf("interpreter %s already exists", name)
+	}
+	child := New(append([]Option{WithCapabilities(k.caps)}, opts...)...)
+	child.caps &= k.caps
+	child.dropDenied()
+	child.parent = k
+	k.children[name] = child
+	return child, nil
+}
+
+// Child returns the child interpreter called name, or nil.
+func (k *Kittla) Child(name string) *Kittla {
+	return k.children[name]
+}
+
+// ChildNames returns the names of the child interpreters of k, sorted.
+func (k *Kittla) ChildNames() []string {
+	names := make([]string, 0, len(k.children))
+	for n := range k.children {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DeleteChild closes and deletes the child interpreter called name. Aliases to it fail.
+func (k *Kittla) DeleteChild(name string) error {
+	child, present := k.children[name]
+	if !present {
+		return fmt.Errorf("no interpreter named %s", name)
+	}
+	child.Close()
+	child.deleted = true
+	delete(k.children, name)
+	return nil
+}
+
+// Alias creates the command name in k, calling the command target with leading args in the
+// interpreter other. The target runs at the global level of other. Arguments and result are copied.
+func (k *Kittla) Alias(name string, other *Kittla, target string, args ...string) {
+	prefix := make([]*obj, 0, len(args)+1)
+	for _, a := range append([]string{target}, args...) {
+		prefix = append(prefix, &obj{valType: valTypeStr, valStr: []byte(a)})
+	}
+	k.interpAlias(name, other, prefix)
+}
+
+func (k *Kittla) interpAlias(name string, other *Kittla, prefix []*obj) {
+	name = k.qualifyCmd(name)
+	k.commands[name] = []*command{{
+		names:   []string{name},
+		minArgs: -1,
+		maxArgs: -1,
+		id:      k.nextFnId,
+		fn: func(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+			if other.deleted {
+				return nil, fmt.Errorf("%s: target interpreter deleted. Line: %d", cmd, k.currLine)
+			}
+			cmdArgs := make([]*obj, 0, len(prefix)+len(args))
+			for _, o := range append(prefix[:len(prefix):len(prefix)], args...) {
+				cmdArgs = append(cmdArgs, crossValue(o))
+			}
+
+			other.frames = append(other.frames, other.currFrame)
+			other.currFrame = other.global
+
+			res, err := other.callValue(newList(cmdArgs))
+
+			other.currFrame = other.frames[len(other.frames)-1]
+			other.frames = other.frames[:len(other.frames)-1]
+			other.isBreak, other.isContinue, other.isReturn = false, false, false
+
+			if err != nil {
+				return nil, err
+			}
+			return crossValue(res), nil
+		},
+	}}
+	k.nextFnId++
+}
+
+var interpEnsemble = ensemble{
+	"alias":    {minArgs: 4, maxArgs: -1, fn: interpAlias},
+	"children": {minArgs: 0, maxArgs: 0, fn: interpChildren},
+	"delete":   {minArgs: 1, maxArgs: -1, fn: interpDelete},
+	"eval":     {minArgs: 2, maxArgs: -1, fn: interpEval},
+	"exists":   {minArgs: 1, maxArgs: 1, fn: interpExists},
+}
+
+func init() {
+	// Added here, as creating an interpreter refers back to builtinCommands
+	interpEnsemble["create"] = &command{minArgs: 0, maxArgs: 2, fn: interpCreate}
+}
+
+// The interpreter named by a path, {} is k itself.
+func (k *Kittla) interpPath(path *obj) (*Kittla, error) {
+	if path.toString() == "" {
+		return k, nil
+	}
+	child, present := k.children[path.toString()]
+	if !present {
+		return nil, fmt.Errorf("no interpreter named %s", path.toString())
+	}
+	return child, nil
+}
+
+// interp alias src srcCmd target targetCmd ?arg ...?
+func interpAlias(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	src, err := k.interpPath(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	target, err := k.interpPath(args[2])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+
+	prefix := make([]*obj, 0, len(args)-3)
+	for _, o := range args[3:] {
+		prefix = append(prefix, o.clone())
+	}
+	src.interpAlias(args[1].toString(), target, prefix)
+	return args[1], nil
+}
+
+func interpChildren(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	return matchNames(k.ChildNames(), ""), nil
+}
+
+// interp create ?-safe? ?name?
+// A -safe child gets no capabilities.
+func interpCreate(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	var opts []Option
+	if len(args) > 0 && args[0].toString() == "-safe" {
+		opts = append(opts, WithCapabilities())
+		args = args[1:]
+	}
+
+	var name string
+	switch len(args) {
+	case 0:
+		for i := 0; name == "" || k.children[name] != nil; i++ {
+			name = "interp" + strconv.Itoa(i)
+		}
+	case 1:
+		name = args[0].toString()
+	default:
+		return nil, fmt.Errorf("%s: bad option %s, must be -safe. Line: %d", cmd, args[0].toString(), k.currLine)
+	}
+
+	if _, err := k.CreateChild(name, opts...); err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+	return &obj{valType: valTypeStr, valStr: []byte(name)}, nil
+}
+
+func interpDelete(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	for i := range args {
+		if err := k.DeleteChild(args[i].toString()); err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+	}
+	return nil, nil
+}
+
+// interp eval name script ...
+// The scripts are joined with spaces, like eval.
+func interpEval(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	child, err := k.interpPath(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+	}
+
+	script := make([]string, len(args)-1)
+	for i := range args[1:] {
+		script[i] = args[i+1].toString()
+	}
+	res, err := child.evalGlobal(strings.Join(script, " "))
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v", cmd, args[0].toString(), err)
+	}
+	return crossValue(res), nil
+}
+
+func interpExists(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	_, err := k.interpPath(args[0])
+	return &obj{valType: valTypeBool, valBool: err == nil}, nil
+}
@@ -1,10 +1,12 @@
 package kittla
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"os"
 	"strconv"
+	"strings"
 )
 
 type valueType int
@@ -15,27 +17,51 @@ const (
 	valTypeBool
 	valTypeStr
 	valTypeFn
+	valTypeLink
+	valTypeList
+	valTypeChan
+	valTypeHandle
 )
 
 type obj struct {
 	valType valueType
 
-	valInt   int
-	valFloat float64
-	valBool  bool
-	valStr   []byte
-	valFn    *command
+	valInt    int
+	valFloat  float64
+	valBool   bool
+	valStr    []byte
+	valFn     *command
+	valLink   *varLink
+	valList   []*obj
+	valChan   *channel
+	valHandle *handle
+}
+
+// A variable that refers to a variable in another frame. Created by upvar and global.
+type varLink struct {
+	frame *frame
+	name  string
 }
 
 func (o *obj) clone() *obj {
 	oc := &obj{
-		valType:  o.valType,
-		valInt:   o.valInt,
-		valFloat: o.valFloat,
-		valBool:  o.valBool,
-		valStr:   make([]byte, cap(o.valStr)),
+		valType:   o.valType,
+		valInt:    o.valInt,
+		valFloat:  o.valFloat,
+		valBool:   o.valBool,
+		valStr:    make([]byte, len(o.valStr)),
+		valFn:     o.valFn,
+		valLink:   o.valLink,
+		valChan:   o.valChan,
+		valHandle: o.valHandle,
 	}
 	copy(oc.valStr, o.valStr)
+	if o.valList != nil {
+		oc.valList = make([]*obj, len(o.valList))
+		for i := range o.valList {
+			oc.valList[i] = o.valList[i].clone()
+		}
+	}
 	return oc
 }
 
@@ -53,7 +79,20 @@ func (o *obj) toBytes() []byte {
 	case valTypeStr:
 		return o.valStr
 	case valTypeFn:
+		if o.valFn.body == nil {
+			return []byte(o.valFn.names[0])
+		}
 		return o.valFn.body.toBytes()
+	case valTypeList:
+		return listToBytes(o.valList)
+	case valTypeChan:
+		return []byte(o.valChan.name)
+	case valTypeHandle:
+		return []byte(o.valHandle.name)
+	case valTypeLink:
+		if v, present := o.valLink.frame.getVar(o.valLink.name); present {
+			return v.toBytes()
+		}
 	}
 	return nil
 }
@@ -85,10 +124,120 @@ func (o *obj) optimize() *obj {
 	return o
 }
 
+// Scoping rules:
+//   - The global frame holds the variables set at top level. It lives as long as the Kittla instance.
+//   - Each command call gets a new command frame. Globals are not visible unless declared with
+//     global, linked with upvar or accessed by the qualified name ::name.
+//   - An anonymous command captures the frame it is created in, by reference. When called, lookups
+//     that fail in its command frame continue in the captured frame, and changes to such variables
+//     are seen by both. New variables are still created in the command frame.
+//   - The body of if, elif, else, while and loop is executed in a block frame. Variables declared
+//     with local belong to the block. Lookup walks outward through the enclosing blocks to the
+//     global or command frame. A new variable created with set ends up in the global or command frame.
 type frame struct {
 	prevCmd CmdID
 	ifTaken bool // Changed if prevCmd == CMD_IF || CMD_ELIF
 	objects map[string]*obj
+	parent  *frame     // Enclosing frame of a block. nil for the global frame and command frames
+	closure *frame     // Frame captured by an anonymous command. Only set on command frames
+	call    []*obj     // Command name and arguments of a command frame
+	ns      *namespace // Namespace of a command frame, global or namespace frame
+}
+
+// Returns the frame that starts the level f belongs to, i.e. the global frame or a command frame.
+func (f *frame) root() *frame {
+	for f.parent != nil {
+		f = f.parent
+	}
+	return f
+}
+
+// Returns the frame that holds name, walking outward to the root and on into any captured
+// frame. nil if none does.
+func (f *frame) lookup(name string) *frame {
+	for f != nil {
+		if _, present := f.objects[name]; present {
+			return f
+		}
+		f = f.next()
+	}
+	return nil
+}
+
+// The frame variables not found in f are looked up in, the enclosing or captured one.
+func (f *frame) next() *frame {
+	if f.parent != nil {
+		return f.parent
+	}
+	return f.closure
+}
+
+// Looks up a variable, links are followed.
+func (f *frame) getVar(name string) (*obj, bool) {
+	s := f.lookup(name)
+	if s == nil {
+		return nil, false
+	}
+	o := s.objects[name]
+	if o.valType == valTypeLink {
+		return o.valLink.frame.getVar(o.valLink.name)
+	}
+	return o, true
+}
+
+// Sets a variable, if it is a link, the linked variable is set. New variables are created in
+// the root frame.
+func (f *frame) setVar(name string, o *obj) {
+	s := f.lookup(name)
+	if s == nil {
+		s = f.root()
+	} else if v := s.objects[name]; v.valType == valTypeLink {
+		v.valLink.frame.setVar(v.valLink.name, o)
+		return
+	}
+	s.objects[name] = o
+}
+
+// Removes a variable. If it is a link, the linked variable is removed. Returns false if there is
+// no such variable.
+func (f *frame) unsetVar(name string) bool {
+	s := f.lookup(name)
+	if s == nil {
+		return false
+	}
+	if v := s.objects[name]; v.valType == valTypeLink {
+		return v.valLink.frame.unsetVar(v.valLink.name)
+	}
+	delete(s.objects, name)
+	return true
+}
+
+// Declares a variable in f itself, shadowing any variable with the same name further out.
+func (f *frame) setLocal(name string, o *obj) {
+	if f.objects == nil {
+		f.objects = make(map[string]*obj)
+	}
+	f.objects[name] = o
+}
+
+// Makes name in f refer to otherName in other. Fails if otherName is, or links on to, name.
+func (f *frame) linkVar(name string, other *frame, otherName string) error {
+	for other != nil {
+		s := other.lookup(otherName)
+		if s == nil {
+			s = other.root()
+		}
+		if s == f.root() && otherName == name {
+			return fmt.Errorf("can't link variable %s to itself", name)
+		}
+		v := s.objects[otherName]
+		if v == nil || v.valType != valTypeLink {
+			break
+		}
+		other, otherName = v.valLink.frame, v.valLink.name
+	}
+	f.root().objects[name] = &obj{valType: valTypeLink, valLink: &varLink{frame: other, name: otherName}}
+	return nil
 }
 
 // Kittla instance
@@ -97,18 +246,65 @@ type Kittla struct {
 	currLine  int
 	frames    []*frame
 	currFrame *frame
+	global    *frame // Frame of level #0, see frame for the scoping rules
+	globalNs  *namespace
+	script    string // File name of the script being executed, if any
+
+	modulePath []string          // Directories searched by package require
+	packages   map[string]string // Versions of loaded packages
+	loading    map[string]bool   // Packages being loaded
+
+	channels   map[string]*channel // Open channels by name
+	nextChanId int
+
+	handles      map[string]*handle // Handles by name
+	handleOf     map[any]*handle    // Handles by value, for comparable values
+	nextHandleId int
 
 	isContinue bool // Set until continue is handled
 	isBreak    bool // Set until break is handled
 	isReturn   bool // set until return is handled
 
+	caps   Capability            // Capabilities given by the host
+	denied map[string]Capability // Commands removed for lack of capabilities, and what they need
+
+	parent   *Kittla            // Interpreter that created this one with interp create
+	children map[string]*Kittla // Child interpreters by name
+	deleted  bool
+
+	ctx context.Context // Passed to bound Go functions, see Bind
+
+	handlers      map[string][]*eventHandler // Event handlers added by on, by event
+	events        map[string]bool            // Known events, any event is accepted if nil
+	nextHandlerId int
+
+	timers      []*timer // Scripts scheduled with after
+	nextTimerId int
+	clock       clock // Clock of the event loop, replaced by tests
+
+	coroutine  *coroutine          // Running coroutine, if any
+	coroutines map[*coroutine]bool // Coroutines not finished
+	nextGenId  int
+
 	nextFnId CmdID
 }
 
-// New returns a new instance of the kittla language
-func New() *Kittla {
-	k := &Kittla{commands: getCmdMap(), nextFnId: CMD_END_OF_BUILT_IN + 1}
+// New returns a new instance of the kittla language, configured by opts.
+func New(opts ...Option) *Kittla {
+	k := &Kittla{commands: getCmdMap(), nextFnId: CMD_END_OF_BUILT_IN + 1, caps: CAP_ALL, ctx: context.Background(),
+		denied: make(map[string]Capability), packages: make(map[string]string), loading: make(map[string]bool),
+		channels: stdChannels(), children: make(map[string]*Kittla), handles: make(map[string]*handle),
+		handleOf: make(map[any]*handle), handlers: make(map[string][]*eventHandler),
+		coroutines: make(map[*coroutine]bool), clock: realClock{}}
+	for _, opt := range opts {
+		opt(k)
+	}
+	k.dropDenied()
+
 	k.currFrame = &frame{objects: make(map[string]*obj)}
+	k.global = k.currFrame
+	k.globalNs = &namespace{children: make(map[string]*namespace), vars: k.global}
+	k.global.ns = k.globalNs
 	return k
 }
 
@@ -121,16 +317,27 @@ func (k *Kittla) executeCmd(args []*obj) (*obj, error) {
 	var present bool
 	var ano bool
 
-	if o, exists := k.currFrame.objects[cmdName]; exists && k.currFrame.objects[cmdName].valType == valTypeFn {
+	if args[0].valType == valTypeFn {
+		cmdName = "anonymous command"
+		cmd = []*command{args[0].valFn}
+		present = true
+		ano = true
+	} else if o, exists := k.getVar(cmdName); exists && o.valType == valTypeFn {
 		cmd = []*command{o.valFn}
 		present = true
 		ano = true
 	} else {
-		cmd, present = k.commands[cmdName]
+		cmd, cmdName, present = k.resolveCmd(cmdName)
 	}
 
 	if !present {
-		return k.commands["unknown"][0].fn(k, CMD_UNKNOWN, cmdName, args[1:])
+		if _, denied := k.denied[cmdName]; denied {
+			return nil, k.permissionError(cmdName)
+		}
+		if unknown, present := k.commands["unknown"]; present {
+			return unknown[0].fn(k, CMD_UNKNOWN, cmdName, args[1:])
+		}
+		return cmdUnknown(k, CMD_UNKNOWN, cmdName, args[1:])
 	}
 
 	minArgs := math.MaxInt
@@ -149,7 +356,7 @@ func (k *Kittla) executeCmd(args []*obj) (*obj, error) {
 		if cmd[i].minArgs == -1 || len(args[1:]) >= cmd[i].minArgs {
 			if cmd[i].maxArgs == -1 || len(args[1:]) <= cmd[i].maxArgs {
 				defer func() { k.currFrame.prevCmd = cmd[i].id }()
-				if !ano {
+				if !ano || cmd[i].body == nil {
 					return cmd[i].fn(k, cmd[i].id, cmdName, args[1:])
 				} else {
 					return call(k, cmd[0], cmdName, args[1:])
@@ -170,6 +377,77 @@ func (k *Kittla) executeCmd(args []*obj) (*obj, error) {
 
 }
 
+// Looks up a variable in the current frame. Qualified names, like ::name or ns::name, are looked
+// up among the namespace variables.
+func (k *Kittla) getVar(name string) (*obj, bool) {
+	f, name, err := k.varFrame(name)
+	if err != nil {
+		return nil, false
+	}
+	return f.getVar(name)
+}
+
+// Sets a variable in the current frame, or a namespace variable for qualified names.
+func (k *Kittla) setVar(name string, o *obj) error {
+	f, name, err := k.varFrame(name)
+	if err != nil {
+		return err
+	}
+	f.setVar(name, o)
+	return nil
+}
+
+// Removes a variable in the current frame, or a namespace variable for qualified names.
+func (k *Kittla) unsetVar(name string) bool {
+	f, name, err := k.varFrame(name)
+	if err != nil {
+		return false
+	}
+	return f.unsetVar(name)
+}
+
+// Returns the innermost frame of the given level. The level is either relative, "1" is the
+// caller of the current command, or absolute, "#0" is the global frame.
+func (k *Kittla) levelFrame(level string) (*frame, []*frame, error) {
+	all := append(k.frames[:len(k.frames):len(k.frames)], k.currFrame)
+
+	var up int
+	if strings.HasPrefix(level, "#") {
+		abs, err := strconv.Atoi(level[1:])
+		if err != nil || abs < 0 {
+			return nil, nil, fmt.Errorf("bad level: %s", level)
+		}
+		curr := 0
+		for _, f := range all[1:] {
+			if f.parent == nil {
+				curr++
+			}
+		}
+		up = curr - abs
+	} else {
+		var err error
+		if up, err = strconv.Atoi(level); err != nil {
+			return nil, nil, fmt.Errorf("bad level: %s", level)
+		}
+	}
+
+	if up < 0 {
+		return nil, nil, fmt.Errorf("bad level: %s", level)
+	}
+
+	i := len(all) - 1
+	for ; up > 0; up-- {
+		for all[i].parent != nil {
+			i--
+		}
+		if i == 0 {
+			return nil, nil, fmt.Errorf("bad level: %s", level)
+		}
+		i--
+	}
+	return all[i], all[:i:i], nil
+}
+
 // Expands any $name to the actual value.
 func (k *Kittla) expandVar(cb *codeBlock) (*obj, error) {
 
@@ -188,6 +466,13 @@ func (k *Kittla) expandVar(cb *codeBlock) (*obj, error) {
 		}
 	} else {
 
+		if cb.atQualifier() {
+			varName = append(varName, cb.next(), cb.next())
+			if cb.eof {
+				return nil, fmt.Errorf("Unexpected end of file. Line: %d", cb.lineNum)
+			}
+		}
+
 		c = cb.next()
 
 		if !validStartChar(c) {
@@ -201,6 +486,11 @@ func (k *Kittla) expandVar(cb *codeBlock) (*obj, error) {
 
 			c = cb.peek()
 
+			if cb.atQualifier() {
+				varName = append(varName, cb.next(), cb.next())
+				continue
+			}
+
 			if validChar(c) {
 				varName = append(varName, c)
 				cb.next()
@@ -212,7 +502,7 @@ func (k *Kittla) expandVar(cb *codeBlock) (*obj, error) {
 		}
 
 	}
-	if v, present := k.currFrame.objects[string(varName)]; present {
+	if v, present := k.getVar(string(varName)); present {
 		return v, nil
 	}
 	return nil, fmt.Errorf("Unknown variable: %s Line: %d", string(varName), cb.lineNum)
@@ -252,13 +542,22 @@ func (k *Kittla) parse(cb *codeBlock, isPre bool) ([]*obj, error) {
 		if len(currArg) != 0 {
 			currArg = append(currArg, result.toBytes()...)
 		} else if currObj != nil {
-			currArg = append(currObj.toBytes(), result.toBytes()...)
+			currArg = append(append(currArg, currObj.toBytes()...), result.toBytes()...)
 			currObj = nil
 		} else {
 			currObj = result
 		}
 	}
 
+	// Text following a substituted object turns the object into text
+	appendBytes := func(b ...byte) {
+		if currObj != nil {
+			currArg = append(currArg, currObj.toBytes()...)
+			currObj = nil
+		}
+		currArg = append(currArg, b...)
+	}
+
 	appendArg := func() {
 		if len(currArg) > 0 {
 			args = append(args, toObj(currArg))
@@ -300,9 +599,9 @@ parseLoop:
 			case 'v':
 				c = '\v'
 			default:
-				currArg = append(currArg, '\\')
+				appendBytes('\\')
 			}
-			currArg = append(currArg, c)
+			appendBytes(c)
 		case '"':
 			insideString = !insideString
 
@@ -336,7 +635,7 @@ parseLoop:
 			if result, err := cb.untilBrackedEnd(); err == nil {
 				// {} is a valid object
 				appendEmpty = true
-				currArg = append(currArg, result...)
+				appendBytes(result...)
 			} else {
 				return nil, err
 			}
@@ -345,10 +644,10 @@ parseLoop:
 			if !insideString {
 				appendArg()
 			} else {
-				currArg = append(currArg, c)
+				appendBytes(c)
 			}
 		default:
-			currArg = append(currArg, c)
+			appendBytes(c)
 		}
 	}
 	appendArg()
@@ -364,12 +663,13 @@ func (k *Kittla) executeCore(cb *codeBlock, pushFrame bool) (*obj, CmdID, error)
 
 	if pushFrame {
 		k.frames = append(k.frames, k.currFrame)
-		k.currFrame = &frame{objects: k.currFrame.objects}
+		k.currFrame = &frame{parent: k.currFrame}
 	}
 
 	k.currLine = cb.lineNum
 
 	for !cb.eof && err == nil {
+		k.currLine = cb.lineNum
 		args, err = k.parse(cb, false)
 
 		if err != nil {
@@ -1,8 +1,14 @@
 package kittla
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 )
@@ -414,6 +420,1556 @@ var parserTests = []parserTest{
 			"hello": "return 2;",
 		},
 	},
+	{
+		program: "fn incr_counter {name} {upvar 1 $name c; inc c}; set n 1; incr_counter n; incr_counter n",
+		expects: map[string]string{
+			"n": "3",
+		},
+	},
+	{
+		program: "fn setter {name v} {upvar $name c; set c $v}; setter a 5",
+		expects: map[string]string{
+			"a": "5",
+		},
+	},
+	{
+		program: "fn inner {} {upvar 1 x y; set y 2}; fn outer {} {set x 1; inner; return $x}; set a [outer]",
+		expects: map[string]string{
+			"a": "2",
+		},
+	},
+	{
+		program: "fn inner {} {upvar 2 x y; set y 2}; fn outer {} {set x 1; inner; return $x}; set a [outer]",
+		expects: map[string]string{
+			"a": "1",
+			"x": "2",
+		},
+	},
+	{
+		program: "fn inner {} {upvar #0 g y; set y 7}; fn outer {} {inner}; outer",
+		expects: map[string]string{
+			"g": "7",
+		},
+	},
+	{
+		program: "fn test {} {upvar 5 x y}; test",
+		fails:   true,
+	},
+	{
+		program: "fn test {} {upvar 0 x y; upvar 0 y x; set x 1}; test",
+		fails:   true,
+	},
+	{
+		program: "fn test {} {upvar 0 a b; upvar 0 b c; upvar 0 c a; set a 1}; test",
+		fails:   true,
+	},
+	{
+		program: "fn test {} {set x 1; upvar 0 x y; upvar 0 y z; set z 2; return $x}; set a [test]",
+		expects: map[string]string{
+			"a": "2",
+		},
+	},
+	{
+		program: "fn test {} {uplevel {set a 3}}; test",
+		expects: map[string]string{
+			"a": "3",
+		},
+	},
+	{
+		program: "fn inner {} {uplevel 2 {set a 4}}; fn outer {} {inner}; outer",
+		expects: map[string]string{
+			"a": "4",
+		},
+	},
+	{
+		program: "fn inner {} {uplevel 1 set b {$a}}; fn outer {} {set a 5; inner; return $b}; set c [outer]",
+		expects: map[string]string{
+			"c": "5",
+		},
+	},
+	{
+		program: "set g 1; fn test {} {global g; inc g 10}; test",
+		expects: map[string]string{
+			"g": "11",
+		},
+	},
+	{
+		program: "fn test {} {global g h; set g 1; set h 2}; test",
+		expects: map[string]string{
+			"g": "1",
+			"h": "2",
+		},
+	},
+	{
+		program: "global g; set g 1",
+		expects: map[string]string{
+			"g": "1",
+		},
+	},
+	{
+		program: "if {1} {local x 1; set y $x}",
+		expects: map[string]string{
+			"y": "1",
+		},
+	},
+	{
+		program: "set x 1; if {1} {local x 2; set y $x}",
+		expects: map[string]string{
+			"x": "1",
+			"y": "2",
+		},
+	},
+	{
+		program: "if {1} {local x 1; while {$x < 3} {inc x}; set y $x}",
+		expects: map[string]string{
+			"y": "3",
+		},
+	},
+	{
+		program: "if {1} {local x 1}; set y $x",
+		fails:   true,
+	},
+	{
+		program: "set i 0; while {$i < 3} {inc i; local n 0; inc n; set last $n}",
+		expects: map[string]string{
+			"i":    "3",
+			"last": "1",
+		},
+	},
+	{
+		program: "fn test {} {if {1} {local x 1; set y 2}; return $y}; set a [test]",
+		expects: map[string]string{
+			"a": "2",
+		},
+	},
+	{
+		program: "set g 1; fn test {} {return $g}; test",
+		fails:   true,
+		expects: map[string]string{
+			"g": "1",
+		},
+	},
+	{
+		program: "set g 1; fn test {} {return $::g}; set a [test]",
+		expects: map[string]string{
+			"a": "1",
+			"g": "1",
+		},
+	},
+	{
+		program: "fn test {} {set ::g 5; set h 6}; test",
+		expects: map[string]string{
+			"g": "5",
+		},
+	},
+	{
+		program: "fn counter {} {set n 0; return [fn {} {inc n}]}; set c [counter]; c; c; set a [c]",
+		expects: map[string]string{
+			"a": "3",
+			"c": "inc n",
+		},
+	},
+	{
+		program: "fn counter {} {set n 0; return [fn {} {inc n}]}; set c1 [counter]; set c2 [counter]; c1; c1; set a [c1]; set b [c2]",
+		expects: map[string]string{
+			"a":  "3",
+			"b":  "1",
+			"c1": "inc n",
+			"c2": "inc n",
+		},
+	},
+	{
+		program: "fn two {} {return \"a b\"}; fn lit {} {return {$x}}; fn five {} {return 5}; set a [two]; set b [lit]; set c [info type [five]]",
+		expects: map[string]string{
+			"a": "a b",
+			"b": "$x",
+			"c": "int",
+		},
+	},
+	{
+		program: "fn mk {} {return [fn {} {return 1}]}; set a [info type [mk]]; set b [[mk]]",
+		expects: map[string]string{
+			"a": "fn",
+			"b": "1",
+		},
+	},
+	{
+		program: "fn each {cb} {$cb 1; $cb 2}; set sum 0; each [fn {x} {inc sum $x}]",
+		expects: map[string]string{
+			"sum": "3",
+		},
+	},
+	{
+		program: "fn partial {op a} {return [fn {b} {$op $a $b}]}; fn add {x y} {eval $x + $y}; set add5 [partial add 5]; set a [add5 3]",
+		expects: map[string]string{
+			"a":    "8",
+			"add5": "$op $a $b",
+		},
+	},
+	{
+		program: "set h [fn {} {set tmp 1}]; h",
+		expects: map[string]string{
+			"h": "set tmp 1",
+		},
+	},
+	{
+		program: "fn test {a args} {return $args}; set a [test 1 2 3 {4 5}]; set n 0; foreach e $a {inc n; set l $e}",
+		expects: map[string]string{
+			"a": "2 3 {4 5}",
+			"n": "3",
+			"l": "4 5",
+			"e": "4 5",
+		},
+	},
+	{
+		program: "fn test {a args} {return $args}; set a [test 1]",
+		expects: map[string]string{
+			"a": "",
+		},
+	},
+	{
+		program: "fn test {a args} {return $a}; set a [test]",
+		fails:   true,
+	},
+	{
+		program: "fn play {{-volume 100} {-fade 0} song} {return $song$volume$fade}; set a [play x]; set b [play -volume 50 -fade 2 y]; set c [play -fade 1 z]",
+		expects: map[string]string{
+			"a": "x1000",
+			"b": "y502",
+			"c": "z1001",
+		},
+	},
+	{
+		program: "fn play {{-volume 100} song} {return $song}; set a [play -- -x]",
+		expects: map[string]string{
+			"a": "-x",
+		},
+	},
+	{
+		program: "fn f {{-n int}} {return $n}; set a [f -n 3]",
+		expects: map[string]string{
+			"a": "3",
+		},
+	},
+	{
+		program: "fn f {{-n int}} {return $n}; f",
+		fails:   true,
+	},
+	{
+		program: "fn play {{-volume 1} x} {return $volume$x}; set a [play -volume 5 -- -x]",
+		expects: map[string]string{
+			"a": "5-x",
+		},
+	},
+	{
+		program: "fn play {{-volume 100} song} {return $song}; play -speed 2 x",
+		fails:   true,
+	},
+	{
+		program: "fn play {{-volume 100} args} {return $volume:$args}; set a [play -volume 5 a b]",
+		expects: map[string]string{
+			"a": "5:a b",
+		},
+	},
+	{
+		program: "fn add {{a int} {b int 1}} -> int {eval $a + $b}; set a [add 2 3]; set b [add 4]; set c [add \"5\"]",
+		expects: map[string]string{
+			"a": "5",
+			"b": "5",
+			"c": "6",
+		},
+	},
+	{
+		program: "fn add {{a int} {b int 1}} -> int {eval $a + $b}; add x",
+		fails:   true,
+	},
+	{
+		program: "fn add {{a int} {b int 1}} -> int {eval $a + $b}; add 1.5",
+		fails:   true,
+	},
+	{
+		program: "fn half {{a float}} -> float {eval $a / 2}; set a [half 3]; set b [half 4]",
+		expects: map[string]string{
+			"a": "1.500000",
+			"b": "2.000000",
+		},
+	},
+	{
+		program: "fn name {} -> int {return abc}; name",
+		fails:   true,
+	},
+	{
+		program: "set h [fn {{s str}} -> str {return $s}]; set a [h 12]",
+		expects: map[string]string{
+			"a": "12",
+			"h": "return $s",
+		},
+	},
+	{
+		program: "fn sum {{args int}} {return $args}; set a [sum 1 2 3]",
+		expects: map[string]string{
+			"a": "1 2 3",
+		},
+	},
+	{
+		program: "fn sum {{args int}} {return $args}; sum 1 x 3",
+		fails:   true,
+	},
+	{
+		program: "fn vol {{-level int 5}} {return $level}; set a [vol -level 7]",
+		expects: map[string]string{
+			"a": "7",
+		},
+	},
+	{
+		program: "fn vol {{-level int 5}} {return $level}; vol -level loud",
+		fails:   true,
+	},
+	{
+		program: "fn t {{a int x}} {}",
+		fails:   true,
+	},
+	{
+		program: "fn t {a} => int {}",
+		fails:   true,
+	},
+	{
+		program: "fn add {a b} {eval $a + $b}; set a [apply add 1 2]; set b [apply [fn {x} {eval $x * 2}] 4]; set c [apply {add 10} 5]",
+		expects: map[string]string{
+			"a": "3",
+			"b": "8",
+			"c": "15",
+		},
+	},
+	{
+		program: "set l [map [fn {x} {eval $x * $x}] {1 2 3}]",
+		expects: map[string]string{
+			"l": "1 4 9",
+		},
+	},
+	{
+		program: "fn odd {x} {eval $x % 2 == 1}; set l [filter odd {1 2 3 4 5}]",
+		expects: map[string]string{
+			"l": "1 3 5",
+		},
+	},
+	{
+		program: "fn add {a b} {eval $a + $b}; set s [reduce add 0 {1 2 3 4}]",
+		expects: map[string]string{
+			"s": "10",
+		},
+	},
+	{
+		program: "set a [sort {3 1 2}]; set b [sort -decreasing {b c a}]; set c [sort {10 9 100}]",
+		expects: map[string]string{
+			"a": "1 2 3",
+			"b": "c b a",
+			"c": "9 10 100",
+		},
+	},
+	{
+		program: "set l [sort -by [fn {a b} {eval $b - $a}] {1 3 2}]",
+		expects: map[string]string{
+			"l": "3 2 1",
+		},
+	},
+	{
+		program: "sort -by [fn {a b} {return x}] {1 2}",
+		fails:   true,
+	},
+	{
+		program: "fn add {a b} {eval $a + $b}; set add5 [curry add 5]; set a [add5 1]; set l [map $add5 {1 2}]",
+		expects: map[string]string{
+			"a":    "6",
+			"add5": "add 5",
+			"l":    "6 7",
+		},
+	},
+	{
+		program: "set mul [fn {a b c} {eval $a * $b * $c}]; set m [curry $mul 2 3]; set a [m 4]",
+		expects: map[string]string{
+			"a":   "24",
+			"m":   "{eval $a * $b * $c} 2 3",
+			"mul": "eval $a * $b * $c",
+		},
+	},
+	{
+		program: "set mul [fn {a b c} {eval $a * $b * $c}]; set m [curry $mul 2 3]; m",
+		fails:   true,
+		expects: map[string]string{
+			"m":   "{eval $a * $b * $c} 2 3",
+			"mul": "eval $a * $b * $c",
+		},
+	},
+	{
+		program: "set x 1; set a [info exists x]; set b [info exists y]",
+		expects: map[string]string{
+			"x": "1",
+			"a": "true",
+			"b": "false",
+		},
+	},
+	{
+		program: "set a [info commands up*]; set b [info commands nosuch*]",
+		expects: map[string]string{
+			"a": "update uplevel upvar",
+			"b": "",
+		},
+	},
+	{
+		program: "set g 1; fn test {x} {set y 2; return [info vars]}; set a [test 1]; set b [info globals ?]",
+		expects: map[string]string{
+			"g": "1",
+			"a": "x y",
+			"b": "a g",
+		},
+	},
+	{
+		program: "fn test {a {b 5} {-c 1} args} {return $a}; set a [info args test]; set b [info body test]; set c [info default test b d]; set e [info default test a g]",
+		expects: map[string]string{
+			"a": "a b -c args",
+			"b": "return $a",
+			"c": "true",
+			"d": "5",
+			"e": "false",
+			"g": "",
+		},
+	},
+	{
+		program: "set a [info type TRUE]; set b [info type F]; set c [info type truthy]",
+		expects: map[string]string{
+			"a": "bool",
+			"b": "bool",
+			"c": "str",
+		},
+	},
+	{
+		program: "info body puts",
+		fails:   true,
+	},
+	{
+		program: "fn inner {} {return [info level]:[info level 0]:[info level -1]}; fn outer {x} {inner}; set a [info level]; set b [outer 7]",
+		expects: map[string]string{
+			"a": "0",
+			"b": "2:inner:outer 7",
+		},
+	},
+	{
+		program: "set a [info type 1]; set b [info type 1.5]; set c [info type true]; set d [info type abc]; fn mk {args} {return $args}; set e [info type [mk 1]]; set g [info type [fn {} {}]]",
+		expects: map[string]string{
+			"a": "int",
+			"b": "float",
+			"c": "bool",
+			"d": "str",
+			"e": "list",
+			"g": "fn",
+		},
+	},
+	{
+		program: "set a [info complete {set a 1}]; set b [info complete {set a [puts}]; set c [info script]",
+		expects: map[string]string{
+			"a": "true",
+			"b": "false",
+			"c": "",
+		},
+	},
+	{
+		program: "info nosuch",
+		fails:   true,
+	},
+	{
+		program: "set a 1; set b 2; set c 3; unset a b",
+		expects: map[string]string{
+			"c": "3",
+		},
+	},
+	{
+		program: "unset nosuch",
+		fails:   true,
+	},
+	{
+		program: "set a 1; unset -nocomplain nosuch a",
+		expects: map[string]string{},
+	},
+	{
+		program: "set a 1; fn test {} {upvar a b; unset b}; test",
+		expects: map[string]string{},
+	},
+	{
+		program: "if {1} {local x 1; unset x; set y [info exists x]}",
+		expects: map[string]string{
+			"y": "false",
+		},
+	},
+	{
+		program: "fn test {} {return 1}; rename test other; set a [other]; set b [info commands test]",
+		expects: map[string]string{
+			"a": "1",
+			"b": "",
+		},
+	},
+	{
+		program: "rename puts say; set a [say hej]",
+		expects: map[string]string{
+			"a": "hej",
+		},
+	},
+	{
+		program: "rename set {}; set a 1",
+		fails:   true,
+	},
+	{
+		program: "rename nosuch other",
+		fails:   true,
+	},
+	{
+		program: "rename unknown {}; nosuch",
+		fails:   true,
+	},
+	{
+		program: "fn volume {op n} {upvar ::vol v; inc v $n}; set vol 10; alias vol+ {volume inc 5}; vol+; vol+",
+		expects: map[string]string{
+			"vol": "20",
+		},
+	},
+	{
+		program: "fn add {a b} {eval $a + $b}; alias add7 add 7; set a [add7 1]",
+		expects: map[string]string{
+			"a": "8",
+		},
+	},
+	{
+		program: "alias a a",
+		fails:   true,
+	},
+	{
+		program: "alias a b; alias b a",
+		fails:   true,
+	},
+	{
+		program: "alias a b; alias b c; alias c a",
+		fails:   true,
+	},
+	{
+		program: "alias a b; alias c a; rename c b",
+		fails:   true,
+	},
+	{
+		program: "fn two {} {return 2}; alias a two; alias b a; set x [b]",
+		expects: map[string]string{
+			"x": "2",
+		},
+	},
+	{
+		program: "namespace eval foo {fn bar {} {return 1}}; set a [foo::bar]; set b [::foo::bar]",
+		expects: map[string]string{
+			"a": "1",
+			"b": "1",
+		},
+	},
+	{
+		program: "namespace eval foo {fn bar {} {return 1}}; bar",
+		fails:   true,
+	},
+	{
+		program: "namespace eval x {fn get {} {return x}}; namespace eval y {fn get {} {return y}}; fn get {} {return g}; set a [x::get][y::get][get]",
+		expects: map[string]string{
+			"a": "xyg",
+		},
+	},
+	{
+		program: "namespace eval foo {fn a {} {return [b]}; fn b {} {return 2}}; set x [foo::a]",
+		expects: map[string]string{
+			"x": "2",
+		},
+	},
+	{
+		program: "fn lib::util::twice {x} {eval $x * 2}; set a [lib::util::twice 4]; set b [namespace children ::lib]",
+		expects: map[string]string{
+			"a": "8",
+			"b": "::lib::util",
+		},
+	},
+	{
+		program: "namespace eval counter {variable n 0; fn next {} {variable n; inc n}}; counter::next; set a [counter::next]; set b $counter::n",
+		expects: map[string]string{
+			"a": "2",
+			"b": "2",
+		},
+	},
+	{
+		program: "namespace eval foo {set x 5}; set a $foo::x; set foo::x 6; set b [namespace eval foo {return $x}]",
+		expects: map[string]string{
+			"a": "5",
+			"b": "6",
+		},
+	},
+	{
+		program: "set nosuch::x 1",
+		fails:   true,
+	},
+	{
+		program: "namespace eval m {namespace export pub*; fn pub1 {} {return 1}; fn priv {} {return 2}}; namespace import m::*; set a [pub1]; set b [info commands priv]",
+		expects: map[string]string{
+			"a": "1",
+			"b": "",
+		},
+	},
+	{
+		program: "namespace eval m {namespace export get; fn get {} {return 1}}; fn get {} {}; namespace import m::get",
+		fails:   true,
+	},
+	{
+		program: "namespace eval m {namespace export *; fn get {} {return 1}; fn g {} {}}; namespace import m::*; fn g {} {return 2}; namespace delete m; set a [info commands get]; set b [g]",
+		expects: map[string]string{
+			"a": "",
+			"b": "2",
+		},
+	},
+	{
+		program: "namespace eval a {namespace eval b {set ::c [namespace current]}}; set d [namespace children]; set e [namespace current]",
+		expects: map[string]string{
+			"c": "::a::b",
+			"d": "::a",
+			"e": "::",
+		},
+	},
+	{
+		program: "namespace eval foo {fn bar {} {}}; namespace delete foo; set a [info commands foo::*]; set b [namespace children]",
+		expects: map[string]string{
+			"a": "",
+			"b": "",
+		},
+	},
+	{
+		program: "namespace eval foo {fn bar {} {}}; rename foo::bar foo::baz; set a [info commands foo::*]",
+		expects: map[string]string{
+			"a": "foo::baz",
+		},
+	},
+	{
+		program: "set v 1; fn up {n} {global v; inc v $n}; ensemble create vol {up up down {dec v}}; vol up 3; vol down",
+		expects: map[string]string{
+			"v": "3",
+		},
+	},
+	{
+		program: "ensemble create vol {up {inc v}}; vol sideways",
+		fails:   true,
+	},
+	{
+		program: "ensemble create vol {up {inc v}}; vol",
+		fails:   true,
+	},
+	{
+		program: "info nosuch",
+		fails:   true,
+	},
+	{
+		program: "info exists a b",
+		fails:   true,
+	},
+	{
+		program: "set a [info type stdout]; puts -nonewline stdout {}",
+		expects: map[string]string{
+			"a": "str",
+		},
+	},
+	{
+		program: "gets nosuch",
+		fails:   true,
+	},
+	{
+		program: "puts stdin hello",
+		fails:   true,
+	},
+	{
+		program: "set a [file join a b /c d]; set b [file dirname /a/b/c.txt]; set c [file size /nosuch/file]",
+		expects: map[string]string{
+			"a": "/c/d",
+			"b": "/a/b",
+		},
+		fails: true,
+	},
+}
+
+func TestEnsemble(t *testing.T) {
+	k := New()
+	k.Ensemble("vol", map[string]string{"up": "inc v", "down": "dec v"})
+	if _, _, err := k.Execute("set v 5; vol up 2; vol down"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := k.getVar("v"); v.toString() != "6" {
+		t.Errorf("v is %s, wanted 6", v.toString())
+	}
+	if _, _, err := k.Execute("vol left"); err == nil || !strings.Contains(err.Error(), "must be one of: down or up") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func writeScript(t *testing.T, dir, name, code string) string {
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestSource(t *testing.T) {
+	dir := t.TempDir()
+	file := writeScript(t, dir, "helpers.ktl", "fn twice {x} {eval $x * 2}\nset where [info script]\n")
+	bad := writeScript(t, dir, "bad.ktl", "set a 1\n\nnosuchcommand\n")
+
+	k := New()
+	if _, _, err := k.Execute(fmt.Sprintf("source %s; set a [twice 21]", file)); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := k.getVar("a"); a.toString() != "42" {
+		t.Errorf("a is %s, wanted 42", a.toString())
+	}
+	if w, _ := k.getVar("where"); w.toString() != file {
+		t.Errorf("info script returned %s, wanted %s", w.toString(), file)
+	}
+
+	_, _, err := k.Execute(fmt.Sprintf("set b 1\nsource %s", bad))
+	if err == nil || !strings.Contains(err.Error(), "Line: 3") {
+		t.Errorf("Expected error on line 3 of %s, got: %v", bad, err)
+	}
+}
+
+func TestPackage(t *testing.T) {
+	dir := t.TempDir()
+	writeScript(t, dir, "greet.ktl", "package provide greet 1.2\ninc loads\nfn hello {} {return hi}\n")
+
+	k := New()
+	k.SetModulePath(dir)
+	if _, _, err := k.Execute("set loads 0; fn f {} {package require greet 1.1}; f; package require greet; set a [hello]"); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := k.getVar("loads"); l.toString() != "1" {
+		t.Errorf("greet loaded %s times", l.toString())
+	}
+	if a, _ := k.getVar("a"); a.toString() != "hi" {
+		t.Errorf("a is %s, wanted hi", a.toString())
+	}
+	for _, prog := range []string{"package require greet 2.0", "package require greet 1.3", "package require nosuch"} {
+		if _, _, err := k.Execute(prog); err == nil {
+			t.Errorf("%s didn't fail", prog)
+		}
+	}
+}
+
+// Checks that the variables of k have the wanted values. A missing variable counts as empty.
+func checkVars(t *testing.T, k *Kittla, want map[string]string) {
+	t.Helper()
+	for name, value := range want {
+		got := ""
+		if v, present := k.getVar(name); present {
+			got = v.toString()
+		}
+		if got != value {
+			t.Errorf("%s is \"%s\", wanted \"%s\"", name, got, value)
+		}
+	}
+}
+
+func TestChannels(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "lyrics.txt")
+
+	k := New()
+	prog := fmt.Sprintf(`set fh [open %s w]
+puts $fh {first line}
+puts -nonewline $fh second
+close $fh
+set fh [open %s]
+set a [gets $fh]
+set n [gets $fh b]
+set c [gets $fh c]
+set e [eof $fh]
+seek $fh 6
+set p [tell $fh]
+set r [read $fh 4]
+seek $fh -6 end
+set rest [read $fh]
+close $fh`, file, file)
+	if _, _, err := k.Execute(prog); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"a": "first line", "b": "second", "n": "6", "c": "-1", "e": "true", "p": "6", "r": "line", "rest": "second"}
+	checkVars(t, k, want)
+	if _, _, err := k.Execute("gets $fh"); err == nil {
+		t.Errorf("gets on a closed channel didn't fail")
+	}
+	// Interpreters share stdin, so none reads ahead of the others
+	if New().channels["stdin"].r != k.Clone().channels["stdin"].r {
+		t.Errorf("stdin isn't shared")
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	writeScript(t, dir, "song.mp3", "la la")
+	writeScript(t, dir, "cover.jpg", "")
+
+	k := New()
+	prog := fmt.Sprintf(`set d %s
+file mkdir [file join $d art old]
+set covers [glob -directory $d *.jpg *.png]
+set dirs [glob -directory $d -types d *]
+set song [file join $d song.mp3]
+set size [file size $song]
+set isfile [file isfile $song]
+set isdir [file isdir $song]
+set root [file tail [file rootname $song]]
+set ext [file extension $song]
+file rename $song [file join $d art song.mp3]
+set moved [file exists $song]
+file delete -force [file join $d art]
+set gone [file exists [file join $d art]]`, dir)
+	if _, _, err := k.Execute(prog); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"covers": filepath.Join(dir, "cover.jpg"), "dirs": filepath.Join(dir, "art"), "size": "5",
+		"isfile": "true", "isdir": "false", "root": "song", "ext": ".mp3", "moved": "false", "gone": "false"}
+	checkVars(t, k, want)
+}
+
+func TestCapabilities(t *testing.T) {
+	k := New(WithCapabilities(CAP_TIME))
+	for _, prog := range []string{"open /etc/passwd", "file exists /", "source x.ktl", "set g glob; $g *"} {
+		if _, _, err := k.Execute(prog); err == nil || !strings.Contains(err.Error(), "permission denied, needs capability fs") {
+			t.Errorf("%s: unexpected error: %v", prog, err)
+		}
+	}
+	if _, _, err := k.Execute("set a [info commands open]; puts -nonewline {}"); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := k.getVar("a"); a.toString() != "" {
+		t.Errorf("info commands found %s", a.toString())
+	}
+	for _, n := range k.Names() {
+		if n == "open" || n == "file exists" {
+			t.Errorf("Names() contains %s", n)
+		}
+	}
+
+	k = New(WithCapabilities(CAP_FS))
+	if _, _, err := k.Execute("file exists /"); err != nil {
+		t.Error(err)
+	}
+	if _, _, err := k.Execute("after 1"); err == nil {
+		t.Errorf("after allowed without the time capability")
+	}
+
+	// Commands of the host
+	k = New(WithCapabilities(CAP_NET))
+	k.Bind("dial", func(addr string) string { return addr }, CAP_NET)
+	k.Bind("run", func(cmd string) string { return cmd }, CAP_EXEC)
+	k.BindObject("env", &testPlayer{}, CAP_ENV, CAP_NET)
+	if _, _, err := k.Execute("dial x"); err != nil {
+		t.Error(err)
+	}
+	for prog, missing := range map[string]string{"run x": "exec", "env get Level": "env"} {
+		if _, _, err := k.Execute(prog); err == nil || !strings.Contains(err.Error(), "permission denied, needs capability "+missing) {
+			t.Errorf("%s: unexpected error: %v", prog, err)
+		}
+	}
+}
+
+func TestInterp(t *testing.T) {
+	k := New()
+	prog := `set secret 42
+fn pair {args} {return $args}
+fn log {msg} {global logged; set logged $msg; return [pair ok $msg]}
+set c [interp create -safe]
+interp alias $c log {} log
+set a [interp eval $c {set secret 1; log {a b}}]
+set b [interp eval $c {info exists secret}]
+set opened [interp eval $c {info commands open}]
+set children [interp children]
+interp delete $c
+set gone [interp exists $c]`
+	if _, _, err := k.Execute(prog); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"secret": "42", "logged": "a b", "a": "ok {a b}", "b": "true", "opened": "", "children": "interp0", "gone": "false"}
+	checkVars(t, k, want)
+	if _, _, err := k.Execute("interp eval interp0 {set x 1}"); err == nil {
+		t.Errorf("eval in a deleted interpreter didn't fail")
+	}
+}
+
+func TestChild(t *testing.T) {
+	k := New(WithCapabilities())
+	child, err := k.CreateChild("plugin", WithCapabilities(CAP_FS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := child.Execute("file exists /"); err == nil {
+		t.Errorf("child got capabilities its parent lacks")
+	}
+
+	k.Execute("set volume 3; fn setvol {v} {global volume; set volume $v}")
+	child.Alias("vol", k, "setvol")
+	if _, _, err := child.Execute("vol 7"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := k.getVar("volume"); v.toString() != "7" {
+		t.Errorf("volume is %s, wanted 7", v.toString())
+	}
+
+	k.DeleteChild("plugin")
+	if k.Child("plugin") != nil {
+		t.Errorf("child not deleted")
+	}
+	k.Alias("plugvol", child, "vol")
+	if _, _, err := k.Execute("plugvol 9"); err == nil {
+		t.Errorf("alias to deleted child didn't fail")
+	}
+}
+
+func TestBind(t *testing.T) {
+	type ctxKey struct{}
+	k := New(WithContext(context.WithValue(context.Background(), ctxKey{}, "player")))
+
+	binds := map[string]any{
+		"add":  func(a int, b float64) float64 { return float64(a) + b },
+		"join": func(sep string, parts ...string) string { return strings.Join(parts, sep) },
+		"sum": func(l []int) int {
+			s := 0
+			for _, i := range l {
+				s += i
+			}
+			return s
+		},
+		"keys": func(m map[string]int) []string { return []string{fmt.Sprint(len(m))} },
+		"who":  func(ctx context.Context) string { return ctx.Value(ctxKey{}).(string) },
+		"div": func(a, b int) (int, error) {
+			if b == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			return a / b, nil
+		},
+		"pair":  func(a any) (any, bool) { return a, true },
+		"small": func(i int8) int8 { return i },
+	}
+	for name, fn := range binds {
+		if err := k.Bind(name, fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := k.Bind("bad", func(c complex128) {}); err == nil {
+		t.Errorf("Binding a func taking a complex128 didn't fail")
+	}
+	var nilFn func()
+	for _, fn := range []any{nil, nilFn, 5} {
+		if err := k.Bind("bad", fn); err == nil {
+			t.Errorf("Binding %v didn't fail", fn)
+		}
+	}
+
+	prog := `set a [add 1 2.5]
+set b [join - x y z]
+set c [sum {1 2 3}]
+set d [keys {x 1 y 2}]
+set e [who]
+set q [div 7 2]
+set g [pair {1 2}]`
+	if _, _, err := k.Execute(prog); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "3.500000", "b": "x-y-z", "c": "6", "d": "2", "e": "player", "q": "3", "g": "{1 2} true"}
+	checkVars(t, k, want)
+	for _, prog := range []string{"div 1 0", "add x 1", "add 1", "small 300", "keys {x}"} {
+		if _, _, err := k.Execute(prog); err == nil {
+			t.Errorf("%s didn't fail", prog)
+		}
+	}
+}
+
+type testPlayer struct {
+	Song     string
+	Level    int
+	Playlist []string
+	secret   int
+}
+
+func (p *testPlayer) Volume(level int) int {
+	p.Level = level
+	return p.Level
+}
+
+func (p *testPlayer) Next() (string, error) {
+	if len(p.Playlist) == 0 {
+		return "", fmt.Errorf("playlist empty")
+	}
+	p.Song, p.Playlist = p.Playlist[0], p.Playlist[1:]
+	return p.Song, nil
+}
+
+func TestBindObject(t *testing.T) {
+	p := &testPlayer{Playlist: []string{"a.mp3", "b.mp3"}}
+	k := New()
+	if err := k.BindObject("player", p); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.BindObject("bad", *p); err == nil {
+		t.Errorf("Binding a struct value didn't fail")
+	}
+
+	prog := `set a [player Volume 40]
+set b [player Next]
+player set Song c.mp3
+set c [player get Song]
+set d [player get Playlist]`
+	if _, _, err := k.Execute(prog); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "40", "b": "a.mp3", "c": "c.mp3", "d": "b.mp3"}
+	checkVars(t, k, want)
+	if p.Level != 40 || p.Song != "c.mp3" {
+		t.Errorf("player not updated: %+v", p)
+	}
+	for _, prog := range []string{"player Next; player Next", "player get secret", "player set Level loud", "player Volume", "player Pause"} {
+		if _, _, err := k.Execute(prog); err == nil {
+			t.Errorf("%s didn't fail", prog)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	k := New(WithCapabilities())
+	k.Register([]Command{
+		{
+			Names:   []string{"scale", "mul"},
+			MinArgs: 2,
+			MaxArgs: 2,
+			Fn: func(k *Kittla, args Args) (any, error) {
+				l, err := ListArg[float64](args, 0)
+				if err != nil {
+					return nil, err
+				}
+				f, err := Arg[float64](args, 1)
+				if err != nil {
+					return nil, err
+				}
+				for i := range l {
+					l[i] *= f
+				}
+				return l, nil
+			},
+		},
+		{
+			Names:   []string{"rm"},
+			MinArgs: 1,
+			MaxArgs: 1,
+			Caps:    CAP_FS,
+			Fn:      func(k *Kittla, args Args) (any, error) { return nil, nil },
+		},
+	})
+
+	if _, _, err := k.Execute("set a [scale {1 2} 1.5]; set b [mul {2} 2]"); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := k.getVar("a"); a.toString() != "1.500000 3.000000" {
+		t.Errorf("a is %s", a.toString())
+	}
+	for _, prog := range []string{"scale {1 x} 2", "scale {1} 2 3", "rm x"} {
+		if _, _, err := k.Execute(prog); err == nil {
+			t.Errorf("%s didn't fail", prog)
+		}
+	}
+}
+
+type testConn struct {
+	addr   string
+	closed bool
+}
+
+func TestHandles(t *testing.T) {
+	k := New()
+	released := make([]string, 0, 2)
+	release := func(v any) { released = append(released, v.(*testConn).addr) }
+
+	first := &testConn{addr: "first"}
+	name := k.NewHandle("conn", first, release)
+	if name != "handle:conn1" {
+		t.Errorf("handle named %s", name)
+	}
+	if v, ok := k.Handle(name); !ok || v != first {
+		t.Errorf("Handle(%s) returned %v", name, v)
+	}
+
+	k.Bind("dial", func(addr string) *testConn { return &testConn{addr: addr} })
+	k.Bind("addr", func(c *testConn) string { return c.addr })
+	k.Bind("same", func(c *testConn) *testConn { return c })
+
+	prog := fmt.Sprintf(`set c [dial second]
+set a [addr $c]
+set b [addr %s]
+set typ [info type $c]
+set same [same $c]`, name)
+	if _, _, err := k.Execute(prog); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"c": "handle:testconn2", "a": "second", "b": "first", "typ": "handle", "same": "handle:testconn2"}
+	checkVars(t, k, want)
+	for _, prog := range []string{"addr nosuch", "addr 5"} {
+		if _, _, err := k.Execute(prog); err == nil {
+			t.Errorf("%s didn't fail", prog)
+		}
+	}
+
+	// Nil values and values that can't be compared
+	nothing := k.NewHandle("nothing", nil, nil)
+	if _, _, err := k.Execute("addr " + nothing); err == nil {
+		t.Errorf("Passing a nil handle didn't fail")
+	}
+	type boxed struct{ v any }
+	k.Bind("box", func() boxed { return boxed{v: []int{1}} })
+	if _, _, err := k.Execute("box; box"); err != nil {
+		t.Error(err)
+	}
+	if err := k.ReleaseHandle(k.NewHandle("boxed", boxed{v: map[int]int{}}, nil)); err != nil {
+		t.Error(err)
+	}
+
+	k.NewHandle("conn", &testConn{addr: "third"}, release)
+	k.Close()
+	if strings.Join(released, " ") != "third first" {
+		t.Errorf("released: %v", released)
+	}
+	if _, ok := k.Handle(name); ok {
+		t.Errorf("%s not released", name)
+	}
+}
+
+func TestGoChannels(t *testing.T) {
+	k := New()
+	events := make(chan int, 4)
+	keys := make(chan string, 4)
+	if err := k.ExposeChan("events", events); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.ExposeChan("keys", keys); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.ExposeChan("bad", 5); err == nil {
+		t.Errorf("Exposing an int as channel didn't fail")
+	}
+
+	events <- 1
+	keys <- "q"
+	prog := `set a [chan recv $events]
+set b [chan recv $events 10]
+select {keys k {set got key:$k} events e {set got event:$e}}
+set none [select {events - {set x 1} timeout 0 {set x none}}]
+select {events - {set y 1} timeout 5 {set y late}}
+select {timeout 0 {set z done}}
+chan send $events 7
+chan close $keys
+set c [chan recv $keys]`
+	if _, _, err := k.Execute(prog); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "1", "b": "", "got": "key:q", "k": "q", "e": "", "none": "none", "x": "none", "y": "late", "z": "done", "c": ""}
+	checkVars(t, k, want)
+	if e := <-events; e != 7 {
+		t.Errorf("received %d, wanted 7", e)
+	}
+	for _, prog := range []string{"chan send $events seven", "chan close $keys", "chan send $keys x", "chan recv nosuch", "select {events}", "select {}",
+		"select {events {set x 1}}", "select {timeout {set x 1}}", "select {timeout x {}}"} {
+		if _, _, err := k.Execute(prog); err == nil {
+			t.Errorf("%s didn't fail", prog)
+		}
+	}
+
+	// Blocking on a channel ends when the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	k = New(WithContext(ctx))
+	k.ExposeChan("blocked", make(chan int))
+	for _, prog := range []string{"chan recv $blocked", "chan send $blocked 1", "select {blocked - {set x 1}}"} {
+		if _, _, err := k.Execute(prog); err == nil || !strings.Contains(err.Error(), "context canceled") {
+			t.Errorf("%s returned %v", prog, err)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	k := New(WithEvents("save", "quit"))
+	prog := `set log {}
+on save {name} {global log; set log "$log saved:$name"}
+set h [on save {name {n int 1}} {global log; set log "$log again:$name:$n"}]
+on quit {} {error}
+on quit {} {global log; set log "$log quit"}`
+	if _, _, err := k.Execute(prog); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := k.Emit("save", "a.txt"); err != nil {
+		t.Error(err)
+	}
+	err := k.Emit("quit")
+	if e, ok := err.(*EventError); !ok || len(e.Errs) != 1 {
+		t.Errorf("quit returned %v, wanted one error", err)
+	}
+	if err := k.Emit("close"); err == nil {
+		t.Errorf("Emitting an unknown event didn't fail")
+	}
+	if _, _, err := k.Execute("off save $h; off quit"); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Emit("save", "b.txt"); err != nil {
+		t.Error(err)
+	}
+	if err := k.Emit("quit"); err != nil {
+		t.Error(err)
+	}
+
+	want := " saved:a.txt again:a.txt:1 quit saved:b.txt"
+	if v, _ := k.getVar("log"); v.toString() != want {
+		t.Errorf("log is \"%v\", wanted \"%s\"", v, want)
+	}
+	for _, prog := range []string{"on close {} {}", "off save nosuch", "off close"} {
+		if _, _, err := k.Execute(prog); err == nil {
+			t.Errorf("%s didn't fail", prog)
+		}
+	}
+}
+
+// A clock that only moves when slept on, or set by the test.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.now = c.now.Add(d)
+	return nil
+}
+
+func TestEventLoop(t *testing.T) {
+	k := New()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	k.clock = clock
+
+	prog := `set log {}
+set errors {}
+fn bgerror {msg} {global errors; set errors "$errors $msg"}
+after 20 {set log "$log late"}
+after 5 {set log "$log early"}
+after idle {set log "$log idle"}
+set c [after 10 {set log "$log cancelled"}]
+after cancel $c
+after 5 {nosuchcommand}
+after 0 {set n 0}
+after 0 {inc n}
+update
+set updated $log`
+	if _, _, err := k.Execute(prog); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := k.getVar("updated"); v.toString() != " idle" {
+		t.Errorf("update ran \"%v\", wanted \" idle\"", v.toString())
+	}
+	if next, ok := k.NextDeadline(); !ok || !next.Equal(clock.now.Add(5*time.Millisecond)) {
+		t.Errorf("Next deadline is %v, %v", next, ok)
+	}
+
+	clock.now = clock.now.Add(5 * time.Millisecond)
+	if n := k.RunPending(); n != 2 {
+		t.Errorf("RunPending ran %d scripts, wanted 2", n)
+	}
+	clock.now = clock.now.Add(15 * time.Millisecond)
+	if _, _, err := k.Execute("after 10 {set ran 1}; update"); err != nil {
+		t.Fatal(err)
+	}
+	if n := k.RunPending(); n != 0 {
+		t.Errorf("RunPending ran %d scripts before their deadline", n)
+	}
+	clock.now = clock.now.Add(10 * time.Millisecond)
+	if n := k.RunPending(); n != 1 {
+		t.Errorf("RunPending ran %d scripts, wanted 1", n)
+	}
+	if _, ok := k.NextDeadline(); ok {
+		t.Errorf("Deadline after all scripts ran")
+	}
+
+	want := map[string]string{"log": " idle early late", "n": "1", "ran": "1"}
+	checkVars(t, k, want)
+	if v, _ := k.getVar("errors"); !strings.Contains(v.toString(), "nosuchcommand") {
+		t.Errorf("bgerror wasn't called, errors is \"%v\"", v.toString())
+	}
+
+	// Waiting sleeps on the clock
+	k = New()
+	start := time.Unix(0, 0)
+	clock = &fakeClock{now: start}
+	k.clock = clock
+	if _, _, err := k.Execute("after 10 {set done 1}; vwait done; after 1; after 10 {set ran 1}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.RunEvents(); err != nil {
+		t.Error(err)
+	}
+	if v, _ := k.getVar("ran"); v.toString() != "1" {
+		t.Errorf("RunEvents didn't run the script")
+	}
+	if d := clock.now.Sub(start); d != 21*time.Millisecond {
+		t.Errorf("Slept %v, wanted 21ms", d)
+	}
+	if _, _, err := k.Execute("vwait n"); err == nil {
+		t.Errorf("vwait with nothing scheduled didn't fail")
+	}
+	if _, _, err := k.Execute("after soon {}"); err == nil {
+		t.Errorf("after with a bad time didn't fail")
+	}
+
+	k = New(WithCapabilities())
+	for _, prog := range []string{"after 5", "after 5 {set x 1}", "vwait x"} {
+		if _, _, err := k.Execute(prog); err == nil || !strings.Contains(err.Error(), "needs capability time") {
+			t.Errorf("%s: unexpected error: %v", prog, err)
+		}
+	}
+}
+
+const counterScript = `namespace eval counter {
+	variable n 0
+	fn next {} {variable n; inc n}
+}
+set total 0
+fn add {x} {global total; inc total $x}
+set greet [fn {} {return hello}]
+set log {}
+on save {} {global log; set log saved}`
+
+func TestClone(t *testing.T) {
+	k := New()
+	if _, _, err := k.Execute(counterScript); err != nil {
+		t.Fatal(err)
+	}
+	c := k.Clone()
+
+	if _, _, err := c.Execute("counter::next; counter::next; add 5; fn add {x} {return replaced}; set g [$greet]"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Emit("save"); err != nil {
+		t.Error(err)
+	}
+	if _, _, err := k.Execute("counter::next; set r [add 1]"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, check := range []struct {
+		k     *Kittla
+		name  string
+		value string
+	}{
+		{k, "counter::n", "1"}, {k, "total", "1"}, {k, "r", "1"}, {k, "log", ""},
+		{c, "counter::n", "2"}, {c, "total", "5"}, {c, "g", "hello"}, {c, "log", "saved"},
+	} {
+		if v, _ := check.k.getVar(check.name); v.toString() != check.value {
+			t.Errorf("%s is \"%v\", wanted \"%s\"", check.name, v.toString(), check.value)
+		}
+	}
+	if res, _, err := c.Execute("add 1"); err != nil || string(res) != "replaced" {
+		t.Errorf("add in the clone returned %s, %v", res, err)
+	}
+}
+
+func TestPool(t *testing.T) {
+	p, err := NewPool(func(k *Kittla) error {
+		_, _, err := k.Execute(counterScript)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				k := p.Get()
+				res, _, err := k.Execute(fmt.Sprintf("add %d; counter::next; counter::next; set r \"$total $counter::n\"", i))
+				if err == nil && string(res) != fmt.Sprintf("%d 2", i) {
+					err = fmt.Errorf("got %s", res)
+				}
+				p.Put(k)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if _, err := NewPool(func(k *Kittla) error {
+		_, _, err := k.Execute("nosuchcommand")
+		return err
+	}); err == nil {
+		t.Errorf("NewPool with a failing init didn't fail")
+	}
+}
+
+func TestGo(t *testing.T) {
+	k := New()
+	prog := `set c [chan create 10]
+set x 5
+fn square {n} {return [expr "$n * $n"]}
+set t1 [go {set x 6; chan send $c "a $x"; set r 42}]
+set r1 [wait $t1]
+set m [chan recv $c]
+loop {
+	go {chan send $c [square $x]}
+	if {$x == 8} {break}
+	inc x
+}
+set sum 0
+set n 0
+loop {
+	inc sum [chan recv $c]
+	inc n
+	if {$n == 4} {break}
+}
+set inner [wait [go {set tk [go {chan create}]; wait $tk}]]`
+	if _, _, err := k.Execute(prog); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"x": "8", "r1": "42", "m": "a 6", "sum": "174"}
+	checkVars(t, k, want)
+	if v, _ := k.getVar("inner"); v.valType != valTypeHandle {
+		t.Errorf("channel from a task isn't a handle: %v", v.toString())
+	}
+
+	for _, prog := range []string{"wait [go {nosuchcommand}]", "wait $c", "wait nosuch", "chan create -1"} {
+		if _, _, err := k.Execute(prog); err == nil {
+			t.Errorf("%s didn't fail", prog)
+		}
+	}
+
+	// Close cancels running tasks and reports errors nobody waited for
+	k = New()
+	k.Bind("block", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	prog = `set errors {}
+fn bgerror {msg} {global errors; set errors "$errors $msg"}
+set failed [go {boom}]
+set blocked [go {block}]
+set waited [go {quiet}]`
+	if _, _, err := k.Execute(prog); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := k.Execute("wait $waited"); err == nil {
+		t.Errorf("waiting for a failed task didn't fail")
+	}
+	tasks := make([]*task, 0, 2)
+	for _, name := range []string{"failed", "blocked"} {
+		v, _ := k.getVar(name)
+		tasks = append(tasks, v.valHandle.value.(*task))
+	}
+	<-tasks[0].done
+	k.Close()
+	select {
+	case <-tasks[1].done:
+	case <-time.After(time.Second):
+		t.Errorf("Close didn't cancel the running task")
+	}
+	if v, _ := k.getVar("errors"); !strings.Contains(v.toString(), "boom") || strings.Contains(v.toString(), "quiet") {
+		t.Errorf("errors is \"%v\"", v.toString())
+	}
+}
+
+func TestCoroutines(t *testing.T) {
+	k := New()
+	prog := `fn counter {start} {
+	set n $start
+	loop {
+		inc n [yield $n]
+	}
+}
+set a [coroutine c counter 10]
+set b [c 5]
+set d [c 2]
+fn two {} {yield 1; yield 2; return done}
+set x "[coroutine t two] [t] [t]"
+fn range {from to} {
+	set i $from
+	while {$i < $to} {
+		yield $i
+		inc i
+	}
+}
+set sum 0
+foreach v [generator range 1 5] {inc sum $v}
+foreach v {1 2 3} {inc sum $v}
+set g [generator range 0 10]
+foreach v $g {if {$v == 2} {break}}
+foreach v $g {set last $v}
+fn selfish {} {yield 1; s}
+coroutine s selfish
+set y "[coroutine y yield 5] [y 7]"
+foreach v [generator range 0 100] {if {$v == 3} {break}}
+coroutine r counter 1
+rename r {}`
+	if _, _, err := k.Execute(prog); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "10", "b": "15", "d": "17", "x": "1 2 done", "sum": "16", "last": "9", "y": "5 7"}
+	checkVars(t, k, want)
+	if _, present := k.getVar("n"); present {
+		t.Errorf("Variable of the coroutine leaked")
+	}
+
+	for _, prog := range []string{"t", "yield 1", "s", "coroutine c counter 1", "foreach v $g {}; foreach v {{a} {} {}", "foreach v [generator range 0 5] {nosuch}", "r"} {
+		if _, _, err := k.Execute(prog); err == nil {
+			t.Errorf("%s didn't fail", prog)
+		}
+	}
+	if len(k.coroutines) != 1 {
+		t.Errorf("%d coroutines suspended, wanted 1", len(k.coroutines))
+	}
+	if len(k.handles) != 0 {
+		t.Errorf("%d generator handles not released", len(k.handles))
+	}
+	k.Close()
+	if len(k.coroutines) != 0 {
+		t.Errorf("%d coroutines suspended after Close", len(k.coroutines))
+	}
+}
+
+func TestNames(t *testing.T) {
+	k := New()
+	if _, _, err := k.Execute("set g 1; namespace eval foo {fn bar {} {}; variable v 1}"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{"g": true, "foo::bar": true, "foo::v": true, "puts": true, "info exists": true}
+	for _, n := range k.Names() {
+		delete(want, n)
+	}
+	if len(want) != 0 {
+		t.Errorf("Names() lacks: %v", want)
+	}
 }
 
 func TestParser(t *testing.T) {
@@ -0,0 +1,86 @@
+package kittla
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Lists are, like in Tcl, space separated elements. Elements with blanks are enclosed in {}.
+
+func newList(elems []*obj) *obj {
+	return &obj{valType: valTypeList, valList: elems}
+}
+
+// Quotes a list element, if needed, so it survives being split again.
+func listElement(b []byte) []byte {
+	if len(b) == 0 {
+		return []byte("{}")
+	}
+	if bytes.ContainsAny(b, " \t\n;\"$[]{}\\") {
+		return append(append([]byte{'{'}, b...), '}')
+	}
+	return b
+}
+
+func listToBytes(elems []*obj) []byte {
+	res := make([]byte, 0, 256)
+	for i := range elems {
+		if i > 0 {
+			res = append(res, ' ')
+		}
+		res = append(res, listElement(elems[i].toBytes())...)
+	}
+	return res
+}
+
+// Splits a string into list elements. Nothing is substituted.
+func splitList(s []byte) ([]*obj, error) {
+	elems := make([]*obj, 0, 16)
+	cb := &codeBlock{code: string(s), lineNum: 1, eof: len(s) == 0}
+
+	for {
+		for !cb.eof && (isBlank(cb.peek()) || cb.peek() == '\n') {
+			cb.next()
+		}
+		if cb.eof {
+			return elems, nil
+		}
+
+		var elem []byte
+		switch cb.peek() {
+		case '{':
+			cb.next()
+			if cb.eof {
+				return nil, fmt.Errorf("unmatched { in list")
+			}
+			var err error
+			if elem, err = cb.untilBrackedEnd(); err != nil {
+				return nil, fmt.Errorf("unmatched { in list")
+			}
+		case '"':
+			cb.next()
+			for {
+				if cb.eof {
+					return nil, fmt.Errorf("unmatched \" in list")
+				}
+				c := cb.next()
+				if c == '"' {
+					break
+				}
+				elem = append(elem, c)
+			}
+		default:
+			for !cb.eof && !isBlank(cb.peek()) && cb.peek() != '\n' {
+				elem = append(elem, cb.next())
+			}
+		}
+		elems = append(elems, toObj(elem))
+	}
+}
+
+func (o *obj) toList() ([]*obj, error) {
+	if o.valType == valTypeList {
+		return o.valList, nil
+	}
+	return splitList(o.toBytes())
+}
@@ -0,0 +1,307 @@
+package kittla
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Commands of a namespace are kept in Kittla.commands under their qualified name, like
+// "player::play". Commands of the global namespace have no qualifier. A name is resolved
+// in the current namespace first, then in the global namespace.
+type namespace struct {
+	name     string // Qualified name without leading ::, "" for the global namespace
+	parent   *namespace
+	children map[string]*namespace
+	vars     *frame              // Namespace variables
+	exports  []string            // Patterns of exported commands
+	imports  map[string]*command // Commands imported from the namespace, by where they were imported
+}
+
+func newNamespace(name string, parent *namespace) *namespace {
+	ns := &namespace{name: name, parent: parent, children: make(map[string]*namespace)}
+	ns.vars = &frame{objects: make(map[string]*obj), ns: ns}
+	return ns
+}
+
+func (ns *namespace) String() string {
+	return "::" + ns.name
+}
+
+// Qualified name of a command or namespace in ns.
+func (ns *namespace) qualify(name string) string {
+	if ns.name == "" {
+		return name
+	}
+	return ns.name + "::" + name
+}
+
+func (k *Kittla) currNs() *namespace {
+	if ns := k.currFrame.root().ns; ns != nil {
+		return ns
+	}
+	return k.globalNs
+}
+
+// Finds the namespace with the given name. Relative names are looked up in the current
+// namespace, then in the global namespace. With create, missing namespaces are created
+// in the current namespace.
+func (k *Kittla) findNs(name string, create bool) *namespace {
+
+	walk := func(ns *namespace) *namespace {
+		for _, part := range strings.Split(name, "::") {
+			if part == "" {
+				continue
+			}
+			child, present := ns.children[part]
+			if !present {
+				if !create {
+					return nil
+				}
+				child = newNamespace(ns.qualify(part), ns)
+				ns.children[part] = child
+			}
+			ns = child
+		}
+		return ns
+	}
+
+	if strings.HasPrefix(name, "::") {
+		return walk(k.globalNs)
+	}
+	if ns := walk(k.currNs()); ns != nil || create {
+		return ns
+	}
+	return walk(k.globalNs)
+}
+
+// Splits a qualified name into namespace and tail. The namespace is "" for unqualified names.
+func splitQualified(name string) (string, string) {
+	i := strings.LastIndex(name, "::")
+	if i == -1 {
+		return "", name
+	}
+	if i == 0 {
+		return "::", name[2:]
+	}
+	return name[:i], name[i+2:]
+}
+
+// Returns the key in k.commands for a command name to be defined in the current namespace.
+// Namespaces in the name are created if missing.
+func (k *Kittla) qualifyCmd(name string) string {
+	nsName, tail := splitQualified(name)
+	if nsName == "" {
+		return k.currNs().qualify(name)
+	}
+	return k.findNs(nsName, true).qualify(tail)
+}
+
+// Resolves a command name. Returns the commands and the key they are stored under.
+func (k *Kittla) resolveCmd(name string) ([]*command, string, bool) {
+	if strings.HasPrefix(name, "::") {
+		cmd, present := k.commands[name[2:]]
+		return cmd, name[2:], present
+	}
+	if ns := k.currNs(); ns != k.globalNs {
+		if cmd, present := k.commands[ns.qualify(name)]; present {
+			return cmd, ns.qualify(name), true
+		}
+	}
+	cmd, present := k.commands[name]
+	return cmd, name, present
+}
+
+// Returns the frame holding a possibly qualified variable and the name within that frame.
+func (k *Kittla) varFrame(name string) (*frame, string, error) {
+	nsName, tail := splitQualified(name)
+	if nsName == "" {
+		return k.currFrame, name, nil
+	}
+	ns := k.findNs(nsName, false)
+	if ns == nil {
+		return nil, "", fmt.Errorf("no such namespace: %s", nsName)
+	}
+	return ns.vars, tail, nil
+}
+
+// Commands stored directly in ns, unqualified.
+func (k *Kittla) nsCommands(ns *namespace) []string {
+	names := make([]string, 0, 16)
+	for n := range k.commands {
+		if nsName, tail := splitQualified(n); nsName == ns.name {
+			names = append(names, tail)
+		}
+	}
+	return names
+}
+
+func (k *Kittla) deleteNs(ns *namespace) {
+	for _, child := range ns.children {
+		k.deleteNs(child)
+	}
+	for _, n := range k.nsCommands(ns) {
+		delete(k.commands, ns.qualify(n))
+	}
+	// Imports still referring to the commands of ns go too
+	for local, c := range ns.imports {
+		if cmds := k.commands[local]; len(cmds) > 0 && cmds[0] == c {
+			delete(k.commands, local)
+		}
+	}
+	_, tail := splitQualified(ns.name)
+	delete(ns.parent.children, tail)
+}
+
+var namespaceEnsemble = ensemble{
+	"children": {minArgs: 0, maxArgs: 1, fn: namespaceChildren},
+	"current":  {minArgs: 0, maxArgs: 0, fn: namespaceCurrent},
+	"delete":   {minArgs: 0, maxArgs: -1, fn: namespaceDelete},
+	"eval":     {minArgs: 2, maxArgs: 2, fn: namespaceEval},
+	"export":   {minArgs: 0, maxArgs: -1, fn: namespaceExport},
+	"import":   {minArgs: 1, maxArgs: -1, fn: namespaceImport},
+}
+
+func namespaceChildren(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	ns := k.currNs()
+	if len(args) == 1 {
+		if ns = k.findNs(args[0].toString(), false); ns == nil {
+			return nil, fmt.Errorf("%s: no such namespace: %s. Line: %d", cmd, args[0].toString(), k.currLine)
+		}
+	}
+	names := make([]string, 0, len(ns.children))
+	for _, child := range ns.children {
+		names = append(names, child.String())
+	}
+	return matchNames(names, ""), nil
+}
+
+func namespaceCurrent(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	return &obj{valType: valTypeStr, valStr: []byte(k.currNs().String())}, nil
+}
+
+func namespaceDelete(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	for i := range args {
+		ns := k.findNs(args[i].toString(), false)
+		if ns == nil || ns == k.globalNs {
+			return nil, fmt.Errorf("%s: can't delete namespace: %s. Line: %d", cmd, args[i].toString(), k.currLine)
+		}
+		k.deleteNs(ns)
+	}
+	return nil, nil
+}
+
+// namespace eval name body
+// Executes body with name as current namespace. Variables set in body are namespace variables.
+func namespaceEval(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	ns := k.findNs(args[0].toString(), true)
+
+	k.frames = append(k.frames, k.currFrame)
+	k.currFrame = ns.vars
+
+	res, _, err := k.executeCore(&codeBlock{code: args[1].toString(), lineNum: k.currLine}, true)
+
+	k.currFrame = k.frames[len(k.frames)-1]
+	k.frames = k.frames[:len(k.frames)-1]
+	return res, err
+}
+
+// namespace export ?-clear? ?pattern ...?
+func namespaceExport(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	ns := k.currNs()
+	if len(args) > 0 && args[0].toString() == "-clear" {
+		ns.exports = nil
+		args = args[1:]
+	}
+	for i := range args {
+		ns.exports = append(ns.exports, args[i].toString())
+	}
+	return matchNames(append([]string{}, ns.exports...), ""), nil
+}
+
+// namespace import ?-force? ns::pattern ...
+func namespaceImport(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	force := false
+	if args[0].toString() == "-force" {
+		force = true
+		args = args[1:]
+	}
+	imported := make([]string, 0, 16)
+	for i := range args {
+		nsName, pattern := splitQualified(args[i].toString())
+		ns := k.findNs(nsName, false)
+		if nsName == "" || ns == nil {
+			return nil, fmt.Errorf("%s: no such namespace: %s. Line: %d", cmd, args[i].toString(), k.currLine)
+		}
+		for _, n := range k.nsCommands(ns) {
+			if ok, _ := path.Match(pattern, n); !ok || !ns.isExported(n) {
+				continue
+			}
+			local := k.currNs().qualify(n)
+			if _, present := k.commands[local]; present && !force {
+				return nil, fmt.Errorf("%s: can't import %s, command already exists. Line: %d", cmd, n, k.currLine)
+			}
+			// A copy, as fn replaces commands in place
+			k.commands[local] = append([]*command{}, k.commands[ns.qualify(n)]...)
+			if ns.imports == nil {
+				ns.imports = make(map[string]*command)
+			}
+			ns.imports[local] = k.commands[local][0]
+			imported = append(imported, n)
+		}
+	}
+	return matchNames(imported, ""), nil
+}
+
+func (ns *namespace) isExported(name string) bool {
+	for _, pattern := range ns.exports {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// variable ?name value ...? ?name?
+// Creates namespace variables. Inside a command, the names are linked to the namespace variables.
+func cmdVariable(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+
+	var res *obj
+	for i := 0; i < len(args); i += 2 {
+		nsName, name := splitQualified(args[i].toString())
+		ns := k.currNs()
+		if nsName != "" {
+			if ns = k.findNs(nsName, false); ns == nil {
+				return nil, fmt.Errorf("%s: no such namespace: %s. Line: %d", cmd, nsName, k.currLine)
+			}
+		}
+
+		if i+1 < len(args) {
+			res = args[i+1].optimize()
+			ns.vars.setVar(name, res)
+		} else if _, present := ns.vars.objects[name]; !present {
+			ns.vars.setVar(name, &obj{valType: valTypeStr})
+		}
+
+		if k.currFrame.root() != ns.vars {
+			if err := k.currFrame.linkVar(name, ns.vars, name); err != nil {
+				return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+			}
+		}
+	}
+	return res, nil
+}
+
+// Qualified names of all namespace variables, outside of the global namespace.
+func (k *Kittla) nsVarNames(ns *namespace) []string {
+	names := make([]string, 0, 16)
+	for _, child := range ns.children {
+		for n := range child.vars.objects {
+			names = append(names, child.qualify(n))
+		}
+		names = append(names, k.nsVarNames(child)...)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -70,6 +70,11 @@ func (cb *codeBlock) peek() byte {
 	return cb.nextPeek(true)
 }
 
+// Tells if the next two characters are ::, the separator in qualified names like ::name
+func (cb *codeBlock) atQualifier() bool {
+	return !cb.eof && cb.idx+1 < len(cb.code) && cb.code[cb.idx] == ':' && cb.code[cb.idx+1] == ':'
+}
+
 // scans forward until none blank or end-of-file
 func (cb *codeBlock) skipBlanks() {
 	for {
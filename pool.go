@@ -0,0 +1,198 @@
+package kittla
+
+import (
+	"fmt"
+)
+
+// An instance of Kittla must only be used by one goroutine at a time. For concurrent use, each
+// goroutine gets its own clone of an initialized interpreter, typically from a Pool.
+
+// Copies the state of an interpreter into a clone. Frames, namespaces and values are copied, so the
+// clone and the original can be used by different goroutines. Commands defined in Go, including
+// the built-in ones, never change and are shared. Commands defined with fn are copied to refer to
+// the frames and namespaces of the clone.
+type cloner struct {
+	k      *Kittla // The clone
+	frames map[*frame]*frame
+	nss    map[*namespace]*namespace
+	cmds   map[*command]*command
+}
+
+func (c *cloner) frame(f *frame) *frame {
+	if f == nil {
+		return nil
+	}
+	if fc, present := c.frames[f]; present {
+		return fc
+	}
+	fc := &frame{prevCmd: f.prevCmd, ifTaken: f.ifTaken, objects: make(map[string]*obj, len(f.objects))}
+	c.frames[f] = fc
+
+	fc.parent = c.frame(f.parent)
+	fc.closure = c.frame(f.closure)
+	fc.ns = c.ns(f.ns)
+	fc.call = c.objs(f.call)
+	for name, o := range f.objects {
+		fc.objects[name] = c.obj(o)
+	}
+	return fc
+}
+
+func (c *cloner) ns(ns *namespace) *namespace {
+	if ns == nil {
+		return nil
+	}
+	if nc, present := c.nss[ns]; present {
+		return nc
+	}
+	nc := &namespace{name: ns.name, children: make(map[string]*namespace, len(ns.children)),
+		exports: append([]string{}, ns.exports...)}
+	c.nss[ns] = nc
+
+	nc.parent = c.ns(ns.parent)
+	nc.vars = c.frame(ns.vars)
+	for name, child := range ns.children {
+		nc.children[name] = c.ns(child)
+	}
+	if ns.imports != nil {
+		nc.imports = make(map[string]*command, len(ns.imports))
+		for local, cmd := range ns.imports {
+			nc.imports[local] = c.cmd(cmd)
+		}
+	}
+	return nc
+}
+
+func (c *cloner) cmd(cmd *command) *command {
+	if cmd == nil || (cmd.ns == nil && cmd.closure == nil) {
+		return cmd
+	}
+	if cc, present := c.cmds[cmd]; present {
+		return cc
+	}
+	cc := *cmd
+	c.cmds[cmd] = &cc
+
+	cc.ns = c.ns(cmd.ns)
+	cc.closure = c.frame(cmd.closure)
+	return &cc
+}
+
+func (c *cloner) obj(o *obj) *obj {
+	if o == nil {
+		return nil
+	}
+	oc := &obj{valType: o.valType, valInt: o.valInt, valFloat: o.valFloat, valBool: o.valBool,
+		valStr: append([]byte{}, o.valStr...), valFn: c.cmd(o.valFn), valList: c.objs(o.valList),
+		valHandle: o.valHandle}
+	if h := o.valHandle; h != nil && c.k.handles[h.name] != nil {
+		oc.valHandle = c.k.handles[h.name]
+	}
+	if o.valLink != nil {
+		oc.valLink = &varLink{frame: c.frame(o.valLink.frame), name: o.valLink.name}
+	}
+	if o.valChan != nil {
+		// Only the standard channels are opened in a clone
+		if oc.valChan = c.k.channels[o.valChan.name]; oc.valChan == nil {
+			oc.valType = valTypeStr
+			oc.valStr = []byte(o.valChan.name)
+		}
+	}
+	return oc
+}
+
+func (c *cloner) objs(l []*obj) []*obj {
+	if l == nil {
+		return nil
+	}
+	lc := make([]*obj, len(l))
+	for i := range l {
+		lc[i] = c.obj(l[i])
+	}
+	return lc
+}
+
+// Clone returns a copy of k, to be used by another goroutine. Variables, namespaces, commands and
+// event handlers are copied, while handles refer to the same Go values. Only the standard channels
+// are open in the clone, and neither child interpreters, coroutines nor scheduled scripts are
+// copied. Aliases keep calling the interpreters they were created for. k must not be used while
+// cloned.
+func (k *Kittla) Clone() *Kittla {
+	ck := &Kittla{commands: make(map[string][]*command, len(k.commands)), nextFnId: k.nextFnId, caps: k.caps,
+		ctx: k.ctx, denied: make(map[string]Capability, len(k.denied)), packages: make(map[string]string, len(k.packages)),
+		loading: make(map[string]bool), channels: stdChannels(), children: make(map[string]*Kittla),
+		handles: make(map[string]*handle, len(k.handles)), handleOf: make(map[any]*handle, len(k.handleOf)),
+		handlers: make(map[string][]*eventHandler, len(k.handlers)), events: k.events,
+		modulePath: append([]string{}, k.modulePath...), nextChanId: k.nextChanId, nextHandleId: k.nextHandleId,
+		nextHandlerId: k.nextHandlerId, nextTimerId: k.nextTimerId, coroutines: make(map[*coroutine]bool),
+		nextGenId: k.nextGenId, clock: k.clock}
+	c := &cloner{k: ck, frames: make(map[*frame]*frame), nss: make(map[*namespace]*namespace),
+		cmds: make(map[*command]*command)}
+
+	// The clone doesn't release the values of the handles, the original does
+	for name, h := range k.handles {
+		hc := *h
+		hc.release = nil
+		ck.handles[name] = &hc
+	}
+	for v, h := range k.handleOf {
+		ck.handleOf[v] = ck.handles[h.name]
+	}
+
+	ck.global = c.frame(k.global)
+	ck.globalNs = c.ns(k.globalNs)
+	ck.currFrame = ck.global
+
+	// The slices are copied too, as fn replaces commands in them
+	for name, cmds := range k.commands {
+		cc := make([]*command, len(cmds))
+		for i := range cmds {
+			cc[i] = c.cmd(cmds[i])
+		}
+		ck.commands[name] = cc
+	}
+	for name, caps := range k.denied {
+		ck.denied[name] = caps
+	}
+	for name, version := range k.packages {
+		ck.packages[name] = version
+	}
+
+	for event, handlers := range k.handlers {
+		hc := make([]*eventHandler, len(handlers))
+		for i, h := range handlers {
+			hc[i] = &eventHandler{id: h.id, fn: c.obj(h.fn)}
+		}
+		ck.handlers[event] = hc
+	}
+	return ck
+}
+
+// Pool hands out interpreters initialized once, for use by concurrent goroutines. A Pool is safe
+// for concurrent use, the interpreters it hands out must each be used by one goroutine at a time.
+type Pool struct {
+	template *Kittla
+}
+
+// NewPool creates an interpreter with opts and initializes it with init, which can for instance
+// bind Go functions and source scripts. The pool hands out clones of it.
+func NewPool(init func(k *Kittla) error, opts ...Option) (*Pool, error) {
+	k := New(opts...)
+	if init != nil {
+		if err := init(k); err != nil {
+			return nil, fmt.Errorf("initializing pool: %v", err)
+		}
+	}
+	return &Pool{template: k}, nil
+}
+
+// Get returns an interpreter in the state init left it in.
+func (p *Pool) Get() *Kittla {
+	return p.template.Clone()
+}
+
+// Put gives back an interpreter from Get. It is closed, rather than reused, as scripts may have
+// changed it.
+func (p *Pool) Put(k *Kittla) {
+	k.Close()
+}
@@ -0,0 +1,156 @@
+package kittla
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// Command is a command implemented in Go, registered with Register. Like the built-in commands,
+// MinArgs and MaxArgs are checked before Fn is called, -1 means no limit. The result of Fn is
+// converted like the results of functions given to Bind. Wrappers calling Go functions can be
+// generated with cmd/kittla-bind.
+type Command struct {
+	Names   []string
+	MinArgs int
+	MaxArgs int
+	Caps    Capability // Capabilities needed to use the command
+	Fn      func(k *Kittla, args Args) (any, error)
+}
+
+// Args are the arguments of a Command. Use Arg and ListArg to get them as Go values.
+type Args struct {
+	k    *Kittla
+	args []*obj
+}
+
+// Len returns the number of arguments.
+func (a Args) Len() int {
+	return len(a.args)
+}
+
+// Context returns the context of the interpreter, see WithContext.
+func (a Args) Context() context.Context {
+	return a.k.ctx
+}
+
+// ArgType are the Go types arguments can be converted to by Arg and ListArg.
+type ArgType interface {
+	int | int64 | float64 | bool | string
+}
+
+// Arg returns argument i converted to T.
+func Arg[T ArgType](a Args, i int) (T, error) {
+	var v T
+	var err error
+	var c *obj
+
+	o := a.args[i]
+	switch p := any(&v).(type) {
+	case *int:
+		if c, err = a.k.convertTo(o, "int"); err == nil {
+			*p = c.valInt
+		}
+	case *int64:
+		if c, err = a.k.convertTo(o, "int"); err == nil {
+			*p = int64(c.valInt)
+		}
+	case *float64:
+		if c, err = a.k.convertTo(o, "float"); err == nil {
+			*p = c.valFloat
+		}
+	case *bool:
+		if c, err = a.k.convertTo(o, "bool"); err == nil {
+			*p = c.valBool
+		}
+	case *string:
+		*p = o.toString()
+	}
+	if err != nil {
+		return v, fmt.Errorf("argument %d %v", i+1, err)
+	}
+	return v, nil
+}
+
+// ListArg returns argument i, a list, converted to a slice of T.
+func ListArg[T ArgType](a Args, i int) ([]T, error) {
+	l, err := a.args[i].toList()
+	if err != nil {
+		return nil, fmt.Errorf("argument %d %v", i+1, err)
+	}
+	res := make([]T, len(l))
+	for j := range l {
+		if res[j], err = Arg[T](Args{k: a.k, args: l}, j); err != nil {
+			return nil, fmt.Errorf("argument %d element %v", i+1, err)
+		}
+	}
+	return res, nil
+}
+
+// HandleArg returns argument i, a handle, as the Go value it holds. See NewHandle.
+func HandleArg[T any](a Args, i int) (T, error) {
+	var v T
+	h, present := a.k.handle(a.args[i])
+	if !present {
+		return v, fmt.Errorf("argument %d isn't a handle", i+1)
+	}
+	v, ok := h.value.(T)
+	if !ok {
+		return v, fmt.Errorf("argument %d must be a handle of %T, got %s", i+1, v, h.typ)
+	}
+	return v, nil
+}
+
+// Converts a result of a Go command to a kittla value.
+func (k *Kittla) fromAny(v any) *obj {
+	switch r := v.(type) {
+	case nil:
+		return nil
+	case int:
+		return &obj{valType: valTypeInt, valInt: r}
+	case float64:
+		return &obj{valType: valTypeFloat, valFloat: r}
+	case bool:
+		return &obj{valType: valTypeBool, valBool: r}
+	case string:
+		return &obj{valType: valTypeStr, valStr: []byte(r)}
+	}
+	return k.fromGo(reflect.ValueOf(v))
+}
+
+// Register adds commands implemented in Go. Commands needing capabilities k lacks are left out.
+func (k *Kittla) Register(cmds []Command) {
+	for i := range cmds {
+		c := cmds[i]
+
+		names := make([]string, len(c.Names))
+		for j := range c.Names {
+			names[j] = k.qualifyCmd(c.Names[j])
+		}
+		if missing := c.Caps &^ k.caps; missing != 0 {
+			for _, name := range names {
+				k.denied[name] |= missing
+			}
+			continue
+		}
+
+		cmd := &command{
+			names:   names,
+			minArgs: c.MinArgs,
+			maxArgs: c.MaxArgs,
+			id:      k.nextFnId,
+			caps:    c.Caps,
+			fn: func(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+				res, err := c.Fn(k, Args{k: k, args: args})
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+				}
+				return k.fromAny(res), nil
+			},
+		}
+		k.nextFnId++
+		for _, name := range names {
+			k.commands[name] = []*command{cmd}
+		}
+	}
+}
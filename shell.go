@@ -56,14 +56,21 @@ func (k *Kittla) GetNumUnclosed(prog string) int {
 	return totDepth
 }
 
-// Fetches a list of all commands plus variables. Returned alphabetically sorted.
+// Fetches a list of all commands plus variables. Commands and variables in namespaces have
+// qualified names, like ns::name. Subcommands of ensembles are included as "cmd sub".
+// Returned alphabetically sorted.
 // Useful for shell tab completion
 func (k *Kittla) Names() []string {
 
 	names := make([]string, 0, 1024)
 
-	for name := range k.commands {
+	for name, cmds := range k.commands {
 		names = append(names, name)
+		for _, c := range cmds {
+			for _, sub := range c.ensemble.subNames() {
+				names = append(names, name+" "+sub)
+			}
+		}
 	}
 
 	// FIXME: Consider what to add..
@@ -71,6 +78,8 @@ func (k *Kittla) Names() []string {
 		names = append(names, i)
 	}
 
+	names = append(names, k.nsVarNames(k.globalNs)...)
+
 	sort.Strings(names)
 	return names
 }
@@ -0,0 +1,161 @@
+package kittla
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Executes the file name. Line numbers in errors are relative to the file, and info script
+// returns name while it runs.
+func (k *Kittla) sourceFile(name string) (*obj, error) {
+	code, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	prevScript, prevLine := k.script, k.currLine
+	k.script = name
+
+	res, _, err := k.executeCore(&codeBlock{code: string(code), lineNum: 1}, true)
+
+	k.script, k.currLine = prevScript, prevLine
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return res, nil
+}
+
+// ExecuteFile executes the script in the file name. See Execute.
+func (k *Kittla) ExecuteFile(name string) ([]byte, CmdID, error) {
+	code, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, CMD_SOURCE, err
+	}
+	prevScript := k.script
+	k.script = name
+	defer func() { k.script = prevScript }()
+	return k.Execute(string(code))
+}
+
+// SetModulePath sets the directories searched by package require, in order.
+func (k *Kittla) SetModulePath(dirs ...string) {
+	k.modulePath = append([]string{}, dirs...)
+}
+
+// ModulePathFromEnv returns the directories listed in the KITTLAPATH environment variable.
+func ModulePathFromEnv() []string {
+	return filepath.SplitList(os.Getenv("KITTLAPATH"))
+}
+
+func cmdSource(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	res, err := k.sourceFile(args[0].toString())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", cmd, err)
+	}
+	return res, nil
+}
+
+// Compares two versions like 1.2.3. Returns a negative number, zero or a positive number.
+func compareVersions(a, b string) (int, error) {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		var err error
+		if i < len(as) {
+			if x, err = strconv.Atoi(as[i]); err != nil {
+				return 0, fmt.Errorf("bad version %s", a)
+			}
+		}
+		if i < len(bs) {
+			if y, err = strconv.Atoi(bs[i]); err != nil {
+				return 0, fmt.Errorf("bad version %s", b)
+			}
+		}
+		if x != y {
+			return x - y, nil
+		}
+	}
+	return 0, nil
+}
+
+// A version satisfies a requirement if the major numbers are equal and it isn't older.
+func versionSatisfies(have, want string) (bool, error) {
+	c, err := compareVersions(have, want)
+	if err != nil {
+		return false, err
+	}
+	return strings.SplitN(have, ".", 2)[0] == strings.SplitN(want, ".", 2)[0] && c >= 0, nil
+}
+
+var packageEnsemble = ensemble{
+	"provide": {minArgs: 1, maxArgs: 2, fn: packageProvide},
+	"require": {minArgs: 1, maxArgs: 2, fn: packageRequire},
+}
+
+// package provide name ?version?
+// Without version, returns the version of name, if loaded.
+func packageProvide(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	name := args[0].toString()
+	if len(args) == 2 {
+		if _, err := compareVersions(args[1].toString(), "0"); err != nil {
+			return nil, fmt.Errorf("%s: %v. Line: %d", cmd, err, k.currLine)
+		}
+		k.packages[name] = args[1].toString()
+	}
+	return &obj{valType: valTypeStr, valStr: []byte(k.packages[name])}, nil
+}
+
+// package require name ?version?
+// Sources name.ktl from the module path, at the global level, unless already loaded.
+// Returns the provided version.
+func packageRequire(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	name := args[0].toString()
+
+	if _, loaded := k.packages[name]; !loaded {
+		if k.loading[name] {
+			return nil, fmt.Errorf("%s: package %s requires itself. Line: %d", cmd, name, k.currLine)
+		}
+
+		file := ""
+		for _, dir := range k.modulePath {
+			if _, err := os.Stat(filepath.Join(dir, name+".ktl")); err == nil {
+				file = filepath.Join(dir, name+".ktl")
+				break
+			}
+		}
+		if file == "" {
+			return nil, fmt.Errorf("%s: can't find package %s. Line: %d", cmd, name, k.currLine)
+		}
+
+		k.loading[name] = true
+		k.frames = append(k.frames, k.currFrame)
+		k.currFrame = k.global
+
+		_, err := k.sourceFile(file)
+
+		k.currFrame = k.frames[len(k.frames)-1]
+		k.frames = k.frames[:len(k.frames)-1]
+		delete(k.loading, name)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", cmd, err)
+		}
+		if _, loaded := k.packages[name]; !loaded {
+			k.packages[name] = ""
+		}
+	}
+
+	version := k.packages[name]
+	if len(args) == 2 {
+		ok, err := versionSatisfies(version, args[1].toString())
+		if err != nil || !ok {
+			return nil, fmt.Errorf("%s: version conflict for package %s, have %s, need %s. Line: %d",
+				cmd, name, version, args[1].toString(), k.currLine)
+		}
+	}
+	return &obj{valType: valTypeStr, valStr: []byte(version)}, nil
+}
@@ -0,0 +1,91 @@
+package kittla
+
+import (
+	"context"
+	"fmt"
+)
+
+// go runs a script on a goroutine, in a clone of the interpreter, so nothing is shared with the
+// script but handles. Values are passed back by wait, and between scripts by channels from
+// chan create, converted to Go values and back like for bound functions.
+
+type task struct {
+	done   chan struct{} // Closed when the script has finished
+	res    any
+	err    error
+	cancel context.CancelFunc // Cancels the context of the clone
+	waited bool               // Whether the result was taken by wait
+}
+
+// go script
+// Runs script at the global level of a clone of the interpreter, see Clone, on a new goroutine.
+// Returns a handle of the task, for wait. The clone gets a context that is cancelled when the
+// handle is released, by Close. An error nobody waited for is passed to bgerror then.
+func cmdGo(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	t := &task{done: make(chan struct{})}
+	clone := k.Clone()
+	clone.ctx, t.cancel = context.WithCancel(k.ctx)
+	script := args[0].toString()
+
+	go func() {
+		defer close(t.done)
+		defer clone.Close()
+
+		res, err := clone.evalGlobal(script)
+		if err != nil {
+			t.err = err
+		} else if res != nil {
+			t.res = res.toAny()
+		}
+	}()
+
+	release := func(any) {
+		t.cancel()
+		select {
+		case <-t.done:
+			if t.err != nil && !t.waited {
+				k.bgerror(t.err)
+			}
+		default:
+		}
+	}
+	return &obj{valType: valTypeHandle, valHandle: k.newHandle("task", t, release)}, nil
+}
+
+// wait task
+// Waits for the script of the task to finish. Returns its result, or fails with its error.
+func cmdWait(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	var t *task
+	if h, present := k.handle(args[0]); present {
+		t, _ = h.value.(*task)
+	}
+	if t == nil {
+		return nil, fmt.Errorf("%s: \"%s\" isn't a task. Line: %d", cmd, args[0].toString(), k.currLine)
+	}
+
+	select {
+	case <-t.done:
+	case <-k.ctx.Done():
+		return nil, fmt.Errorf("%s: %v. Line: %d", cmd, k.ctx.Err(), k.currLine)
+	}
+	t.waited = true
+	if t.err != nil {
+		return nil, fmt.Errorf("%s: task failed with: %v. Line: %d", cmd, t.err, k.currLine)
+	}
+	return k.fromAny(t.res), nil
+}
+
+// chan create ?size?
+// Creates a channel for passing values between scripts started with go. Values are converted
+// like the arguments of bound functions taking any.
+func chanCreate(k *Kittla, cmdID CmdID, cmd string, args []*obj) (*obj, error) {
+	size := 0
+	if len(args) == 1 {
+		n, err := k.convertTo(args[0], "int")
+		if err != nil || n.valInt < 0 {
+			return nil, fmt.Errorf("%s: bad size %s. Line: %d", cmd, args[0].toString(), k.currLine)
+		}
+		size = n.valInt
+	}
+	return &obj{valType: valTypeHandle, valHandle: k.newHandle("chan", make(chan any, size), nil)}, nil
+}
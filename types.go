@@ -0,0 +1,88 @@
+package kittla
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Type annotations of fn parameters and results. "any" accepts everything.
+var typeNames = map[string]bool{"int": true, "float": true, "bool": true, "str": true, "list": true, "fn": true, "chan": true, "handle": true, "any": true}
+
+func (t valueType) String() string {
+	switch t {
+	case valTypeInt:
+		return "int"
+	case valTypeFloat:
+		return "float"
+	case valTypeBool:
+		return "bool"
+	case valTypeStr:
+		return "str"
+	case valTypeFn:
+		return "fn"
+	case valTypeList:
+		return "list"
+	case valTypeLink:
+		return "link"
+	case valTypeChan:
+		return "chan"
+	case valTypeHandle:
+		return "handle"
+	}
+	return "unknown"
+}
+
+// Checks that o is of the type typ. Conversions are done when nothing is lost: strings holding
+// a number, int to float, anything to str, strings holding a list, command names to fn, channel
+// names to chan and handle names to handle.
+func (k *Kittla) convertTo(o *obj, typ string) (*obj, error) {
+
+	if typ == "" || typ == "any" || o.valType.String() == typ {
+		return o, nil
+	}
+
+	switch typ {
+	case "int":
+		if o.valType == valTypeStr {
+			if v, err := strconv.ParseInt(o.toString(), 0, 64); err == nil {
+				return &obj{valType: valTypeInt, valInt: int(v)}, nil
+			}
+		}
+	case "float":
+		switch o.valType {
+		case valTypeInt:
+			return &obj{valType: valTypeFloat, valFloat: float64(o.valInt)}, nil
+		case valTypeStr:
+			if v, err := strconv.ParseFloat(o.toString(), 64); err == nil {
+				return &obj{valType: valTypeFloat, valFloat: v}, nil
+			}
+		}
+	case "bool":
+		if o.valType == valTypeStr {
+			if v, err := strconv.ParseBool(o.toString()); err == nil {
+				return &obj{valType: valTypeBool, valBool: v}, nil
+			}
+		}
+	case "str":
+		if o.valType != valTypeFn {
+			return &obj{valType: valTypeStr, valStr: o.toBytes()}, nil
+		}
+	case "list":
+		if l, err := o.toList(); err == nil {
+			return newList(l), nil
+		}
+	case "fn":
+		if _, _, present := k.resolveCmd(o.toString()); present && o.valType == valTypeStr {
+			return o, nil
+		}
+	case "chan":
+		if c, err := k.channel(o); err == nil {
+			return &obj{valType: valTypeChan, valChan: c}, nil
+		}
+	case "handle":
+		if h, present := k.handle(o); present {
+			return &obj{valType: valTypeHandle, valHandle: h}, nil
+		}
+	}
+	return nil, fmt.Errorf("must be %s, got %s \"%s\"", typ, o.valType, o.toString())
+}